@@ -0,0 +1,269 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// Suffixes of the account header values, as defined by the spec. All
+// the values are stored in little-endian form.
+//
+// This is the layout with one header field per suffix. Later revisions
+// of the spec pack the version, code size, nonce and balance into a
+// single "basic data" value at suffix 0, and move the code hash to
+// suffix 1. This package, including the empty code hash shortcut taken
+// by NewLeafNode, keeps the layout below, so account roots will differ
+// from those of clients that implement the packed layout.
+const (
+	VersionLeafKey    = 0
+	BalanceLeafKey    = 1
+	NonceLeafKey      = 2
+	CodeKeccakLeafKey = CodeHashVectorPosition
+	CodeSizeLeafKey   = 4
+)
+
+// EmptyCodeHash is the keccak256 hash of empty code.
+var EmptyCodeHash = [32]byte{
+	0xc5, 0xd2, 0x46, 0x01, 0x86, 0xf7, 0x23, 0x3c,
+	0x92, 0x7e, 0x7d, 0xb2, 0xdc, 0xc7, 0x03, 0xc0,
+	0xe5, 0x00, 0xb6, 0x53, 0xca, 0x82, 0x27, 0x3b,
+	0x7b, 0xfa, 0xd8, 0x04, 0x5d, 0x85, 0xa4, 0x70,
+}
+
+// Account holds the header fields of an account.
+type Account struct {
+	Version  byte
+	Balance  *big.Int
+	Nonce    uint64
+	CodeHash []byte
+	CodeSize uint64
+}
+
+// NewEmptyAccount returns the account that is read at a stem that has
+// never been written to.
+func NewEmptyAccount() *Account {
+	return &Account{
+		Balance:  new(big.Int),
+		CodeHash: append([]byte(nil), EmptyCodeHash[:]...),
+	}
+}
+
+// ToValues lays out the account header as leaf values, at the suffixes
+// defined by the spec. All the other values are nil, so that the result
+// can be passed to InsertValuesAtStem without overwriting the storage
+// and code that share the stem.
+func (acc *Account) ToValues() ([][]byte, error) {
+	if acc.Balance != nil && (acc.Balance.Sign() < 0 || acc.Balance.BitLen() > 8*LeafValueSize) {
+		return nil, fmt.Errorf("invalid balance %s", acc.Balance)
+	}
+	if len(acc.CodeHash) != LeafValueSize {
+		return nil, fmt.Errorf("invalid code hash length %d", len(acc.CodeHash))
+	}
+
+	values := make([][]byte, NodeWidth)
+	values[VersionLeafKey] = make([]byte, LeafValueSize)
+	values[VersionLeafKey][0] = acc.Version
+
+	values[BalanceLeafKey] = make([]byte, LeafValueSize)
+	if acc.Balance != nil {
+		putBalance(values[BalanceLeafKey], acc.Balance)
+	}
+
+	values[NonceLeafKey] = make([]byte, LeafValueSize)
+	binary.LittleEndian.PutUint64(values[NonceLeafKey], acc.Nonce)
+
+	values[CodeKeccakLeafKey] = append([]byte(nil), acc.CodeHash...)
+
+	values[CodeSizeLeafKey] = make([]byte, LeafValueSize)
+	binary.LittleEndian.PutUint64(values[CodeSizeLeafKey], acc.CodeSize)
+	return values, nil
+}
+
+// putBalance writes a balance, which must fit in a leaf value, to value
+// in little-endian form.
+func putBalance(value []byte, balance *big.Int) {
+	var be [LeafValueSize]byte
+	balance.FillBytes(be[:])
+	for i := range be {
+		value[i] = be[LeafValueSize-1-i]
+	}
+}
+
+// accountFromValues decodes the account header from the values of a
+// leaf. Missing header values are given their default value.
+func accountFromValues(values [][]byte) (*Account, error) {
+	acc := NewEmptyAccount()
+	for _, idx := range []int{VersionLeafKey, BalanceLeafKey, NonceLeafKey, CodeKeccakLeafKey, CodeSizeLeafKey} {
+		if values[idx] != nil && len(values[idx]) != LeafValueSize {
+			return nil, fmt.Errorf("invalid account header value size %d at suffix %d", len(values[idx]), idx)
+		}
+	}
+	if v := values[VersionLeafKey]; v != nil {
+		acc.Version = v[0]
+	}
+	if v := values[BalanceLeafKey]; v != nil {
+		var be [LeafValueSize]byte
+		for i := range v {
+			be[LeafValueSize-1-i] = v[i]
+		}
+		acc.Balance.SetBytes(be[:])
+	}
+	if v := values[NonceLeafKey]; v != nil {
+		acc.Nonce = binary.LittleEndian.Uint64(v)
+	}
+	if v := values[CodeKeccakLeafKey]; v != nil {
+		acc.CodeHash = append(acc.CodeHash[:0], v...)
+	}
+	if v := values[CodeSizeLeafKey]; v != nil {
+		acc.CodeSize = binary.LittleEndian.Uint64(v)
+	}
+	return acc, nil
+}
+
+// GetAccountOrEmpty reads the account header at stem. If nothing was
+// ever written at that stem, a zero account with an empty code hash is
+// returned; errors are reserved for faults such as a node that could
+// not be resolved.
+func (n *InternalNode) GetAccountOrEmpty(stem []byte, resolver NodeResolverFn) (*Account, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	values, err := n.GetValuesAtStem(stem, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("reading account at stem %x: %w", stem, err)
+	}
+	if values == nil {
+		return NewEmptyAccount(), nil
+	}
+	return accountFromValues(values)
+}
+
+// AddBalance adds delta, which can be negative, to the balance of the
+// account at stem. If the stem holds no account header, e.g. nothing
+// was ever written there or only storage slots were, a complete header
+// holding the resulting balance is written, with the missing fields
+// given their default value. Otherwise, only the balance is written.
+// An error is returned, and the tree left untouched, if the resulting
+// balance is negative or does not fit in a leaf value.
+func (n *InternalNode) AddBalance(stem []byte, delta *big.Int, resolver NodeResolverFn) error {
+	if len(stem) != StemSize {
+		return fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	values, err := n.GetValuesAtStem(stem, resolver)
+	if err != nil {
+		return fmt.Errorf("reading account at stem %x: %w", stem, err)
+	}
+	acc := NewEmptyAccount()
+	if values != nil {
+		if acc, err = accountFromValues(values); err != nil {
+			return err
+		}
+	}
+
+	balance := new(big.Int).Add(acc.Balance, delta)
+	if balance.Sign() < 0 {
+		return fmt.Errorf("insufficient balance at stem %x: %s + %s < 0", stem, acc.Balance, delta)
+	}
+	if balance.BitLen() > 8*LeafValueSize {
+		return fmt.Errorf("balance overflow at stem %x: %s + %s", stem, acc.Balance, delta)
+	}
+
+	if values == nil || !isAccountHeader(values) {
+		acc.Balance = balance
+		if values, err = acc.ToValues(); err != nil {
+			return err
+		}
+	} else {
+		values = make([][]byte, NodeWidth)
+		values[BalanceLeafKey] = make([]byte, LeafValueSize)
+		putBalance(values[BalanceLeafKey], balance)
+	}
+	return n.InsertValuesAtStem(stem, values, resolver)
+}
+
+// isAccountHeader reports whether all the account header values are set
+// in values. Account headers are always written as a whole, so this is
+// how an account stem is told apart from a storage or code stem. Note
+// that a main storage stem whose first five slots are all set can not
+// be distinguished from an account.
+func isAccountHeader(values [][]byte) bool {
+	for _, idx := range []int{VersionLeafKey, BalanceLeafKey, NonceLeafKey, CodeKeccakLeafKey, CodeSizeLeafKey} {
+		if values[idx] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ForEachAccount calls fn, in stem order, for each account in the tree,
+// stopping at the first error. Hashed nodes can not be classified and
+// cause an error to be returned, so the tree must be fully in memory.
+func (n *InternalNode) ForEachAccount(fn func(stem []byte, acc *Account) error) error {
+	for i, child := range n.children {
+		switch child := child.(type) {
+		case Empty:
+		case *InternalNode:
+			if err := child.ForEachAccount(fn); err != nil {
+				return err
+			}
+		case *LeafNode:
+			if child.isPOAStub || !isAccountHeader(child.values) {
+				continue
+			}
+			acc, err := accountFromValues(child.values)
+			if err != nil {
+				return fmt.Errorf("decoding account at stem %x: %w", child.stem, err)
+			}
+			if err := fn(child.stem, acc); err != nil {
+				return err
+			}
+		case HashedNode:
+			return fmt.Errorf("hashed node at depth %d, index %d can not be iterated: %w", n.depth+1, i, errReadFromInvalid)
+		case UnknownNode:
+			return fmt.Errorf("ForEachAccount at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+		default:
+			return errUnknownNodeType
+		}
+	}
+	return nil
+}
+
+// AccountStems returns the stems of all the accounts in the tree, in
+// order. See ForEachAccount for how accounts are identified.
+func (n *InternalNode) AccountStems() ([][]byte, error) {
+	var stems [][]byte
+	err := n.ForEachAccount(func(stem []byte, _ *Account) error {
+		stems = append(stems, append([]byte(nil), stem...))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stems, nil
+}
@@ -0,0 +1,292 @@
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestGetAccountOrEmpty(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	stem := ffx32KeyTest[:StemSize]
+
+	acc, err := root.GetAccountOrEmpty(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance.Sign() != 0 || acc.Nonce != 0 || acc.CodeSize != 0 || !bytes.Equal(acc.CodeHash, EmptyCodeHash[:]) {
+		t.Fatalf("invalid empty account %+v", acc)
+	}
+
+	values := make([][]byte, NodeWidth)
+	balance := make([]byte, LeafValueSize)
+	balance[0], balance[1] = 0x34, 0x12
+	nonce := make([]byte, LeafValueSize)
+	nonce[0] = 7
+	codeHash := bytes.Repeat([]byte{0xaa}, LeafValueSize)
+	values[BalanceLeafKey] = balance
+	values[NonceLeafKey] = nonce
+	values[CodeKeccakLeafKey] = codeHash
+	if err := root.InsertValuesAtStem(stem, values, nil); err != nil {
+		t.Fatal(err)
+	}
+	acc, err = root.GetAccountOrEmpty(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance.Cmp(big.NewInt(0x1234)) != 0 || acc.Nonce != 7 || acc.CodeSize != 0 || !bytes.Equal(acc.CodeHash, codeHash) {
+		t.Fatalf("invalid account %+v", acc)
+	}
+
+	// A stem sharing a prefix with the existing leaf is still absent.
+	other := append([]byte{}, stem...)
+	other[StemSize-1] = 0
+	acc, err = root.GetAccountOrEmpty(other, nil)
+	if err != nil || acc.Nonce != 0 {
+		t.Fatalf("expected an empty account, got %+v, %v", acc, err)
+	}
+
+	// Faults are still reported.
+	root.Commit()
+	root.children[stem[0]] = HashedNode{}
+	if _, err := root.GetAccountOrEmpty(stem, nil); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+}
+
+func TestForEachAccount(t *testing.T) {
+	t.Parallel()
+
+	header := func(nonce byte) [][]byte {
+		values := make([][]byte, NodeWidth)
+		for _, idx := range []int{VersionLeafKey, BalanceLeafKey, NonceLeafKey, CodeSizeLeafKey} {
+			values[idx] = make([]byte, LeafValueSize)
+		}
+		values[NonceLeafKey][0] = nonce
+		values[CodeKeccakLeafKey] = append([]byte{}, EmptyCodeHash[:]...)
+		return values
+	}
+
+	root := New().(*InternalNode)
+	account1 := ffx32KeyTest[:StemSize]
+	account2 := zeroKeyTest[:StemSize]
+	storage := forkOneKeyTest[:StemSize]
+	if err := root.InsertValuesAtStem(account1, header(1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.InsertValuesAtStem(account2, header(2), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(forkOneKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stems, err := root.AccountStems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stems) != 2 || !bytes.Equal(stems[0], account2) || !bytes.Equal(stems[1], account1) {
+		t.Fatalf("invalid account stems %x", stems)
+	}
+
+	var nonces []uint64
+	err = root.ForEachAccount(func(stem []byte, acc *Account) error {
+		if bytes.Equal(stem, storage) {
+			t.Fatal("storage stem reported as an account")
+		}
+		nonces = append(nonces, acc.Nonce)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonces) != 2 || nonces[0] != 2 || nonces[1] != 1 {
+		t.Fatalf("invalid nonces %v", nonces)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	if err := root.ForEachAccount(func([]byte, *Account) error { calls++; return stop }); err != stop || calls != 1 {
+		t.Fatalf("iteration did not stop at the first error: %v, %d calls", err, calls)
+	}
+
+	root.Commit()
+	root.children[0xff] = HashedNode{}
+	if _, err := root.AccountStems(); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+}
+
+func TestAccountToValues(t *testing.T) {
+	t.Parallel()
+
+	balance, _ := new(big.Int).SetString("123456789abcdef0123456789abcdef", 16)
+	acc := &Account{
+		Version:  1,
+		Balance:  balance,
+		Nonce:    0x0102030405060708,
+		CodeHash: bytes.Repeat([]byte{0xaa}, LeafValueSize),
+		CodeSize: 1234,
+	}
+	values, err := acc.ToValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[NonceLeafKey][0] != 0x08 || values[BalanceLeafKey][0] != 0xef {
+		t.Fatalf("values are not little-endian: %x %x", values[NonceLeafKey], values[BalanceLeafKey])
+	}
+	for i := CodeSizeLeafKey + 1; i < NodeWidth; i++ {
+		if values[i] != nil {
+			t.Fatalf("unexpected value at suffix %d", i)
+		}
+	}
+
+	// Round-trip through the tree, next to a storage slot.
+	stem := ffx32KeyTest[:StemSize]
+	root := New().(*InternalNode)
+	if err := root.Insert(append(append([]byte{}, stem...), HeaderStorageOffset), testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.InsertValuesAtStem(stem, values, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := root.GetAccountOrEmpty(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != acc.Version || got.Balance.Cmp(acc.Balance) != 0 || got.Nonce != acc.Nonce || !bytes.Equal(got.CodeHash, acc.CodeHash) || got.CodeSize != acc.CodeSize {
+		t.Fatalf("invalid account after a round-trip: %+v != %+v", got, acc)
+	}
+	slot, err := root.Get(append(append([]byte{}, stem...), HeaderStorageOffset), nil)
+	if err != nil || !bytes.Equal(slot, testValue) {
+		t.Fatalf("storage slot was overwritten: %x, %v", slot, err)
+	}
+
+	// The empty account round-trips as well.
+	values, err = NewEmptyAccount().ToValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := accountFromValues(values)
+	if err != nil || empty.Balance.Sign() != 0 || !bytes.Equal(empty.CodeHash, EmptyCodeHash[:]) {
+		t.Fatalf("invalid empty account after a round-trip: %+v, %v", empty, err)
+	}
+
+	acc.Balance = new(big.Int).Lsh(big.NewInt(1), 256)
+	if _, err := acc.ToValues(); err == nil {
+		t.Fatal("expected an error for a balance larger than 256 bits")
+	}
+}
+
+func TestAddBalance(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	root := New().(*InternalNode)
+
+	// Crediting a missing account creates it.
+	if err := root.AddBalance(stem, big.NewInt(100), nil); err != nil {
+		t.Fatal(err)
+	}
+	acc, err := root.GetAccountOrEmpty(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance.Cmp(big.NewInt(100)) != 0 || !bytes.Equal(acc.CodeHash, EmptyCodeHash[:]) {
+		t.Fatalf("invalid account after credit: %+v", acc)
+	}
+
+	// Other header fields are kept when debiting.
+	acc.Nonce = 7
+	values, err := acc.ToValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.InsertValuesAtStem(stem, values, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AddBalance(stem, big.NewInt(-40), nil); err != nil {
+		t.Fatal(err)
+	}
+	acc, err = root.GetAccountOrEmpty(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance.Cmp(big.NewInt(60)) != 0 || acc.Nonce != 7 {
+		t.Fatalf("invalid account after debit: %+v", acc)
+	}
+
+	// The commitment matches that of an account written directly.
+	expected := New().(*InternalNode)
+	if values, err = acc.ToValues(); err != nil {
+		t.Fatal(err)
+	}
+	if err := expected.InsertValuesAtStem(stem, values, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(expected.Commit()) {
+		t.Fatal("invalid root commitment after balance updates")
+	}
+
+	// Overdrafts and overflows are rejected, leaving the balance as is.
+	if err := root.AddBalance(stem, big.NewInt(-61), nil); err == nil {
+		t.Fatal("expected an error for a negative balance")
+	}
+	if err := root.AddBalance(stem, new(big.Int).Lsh(big.NewInt(1), 8*LeafValueSize), nil); err == nil {
+		t.Fatal("expected an error for a balance overflow")
+	}
+	if acc, err = root.GetAccountOrEmpty(stem, nil); err != nil || acc.Balance.Cmp(big.NewInt(60)) != 0 {
+		t.Fatalf("balance should be unchanged, got %v, %v", acc.Balance, err)
+	}
+}
+
+func TestAddBalanceWithoutAccountHeader(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	root := New().(*InternalNode)
+	// Only a header storage slot is set at the stem.
+	slot := append(append([]byte{}, stem...), HeaderStorageOffset)
+	if err := root.Insert(slot, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AddBalance(stem, big.NewInt(100), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := root.GetValuesAtStem(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAccountHeader(values) {
+		t.Fatal("AddBalance should write a complete account header")
+	}
+	if !bytes.Equal(values[HeaderStorageOffset], testValue) {
+		t.Fatalf("the storage slot was modified: %x", values[HeaderStorageOffset])
+	}
+	stems, err := root.AccountStems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stems) != 1 || !bytes.Equal(stems[0], stem) {
+		t.Fatalf("the account isn't listed: %x", stems)
+	}
+
+	expected := NewEmptyAccount()
+	expected.Balance = big.NewInt(100)
+	header, err := expected.ToValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header[HeaderStorageOffset] = testValue
+	other := New().(*InternalNode)
+	if err := other.InsertValuesAtStem(stem, header, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(other.Commit()) {
+		t.Fatal("invalid root commitment after crediting a stem without header")
+	}
+}
@@ -0,0 +1,120 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// blobStem returns the stem of the index-th leaf of a blob stored at
+// stem. The first leaf is at stem itself, the following ones are at
+// stems derived from it by hashing, so that they are spread over the
+// tree like any other stem.
+func blobStem(stem []byte, index uint64) []byte {
+	if index == 0 {
+		return stem
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], index)
+	h := sha256.New()
+	h.Write(stem)
+	h.Write(buf[:])
+	return h.Sum(nil)[:StemSize]
+}
+
+// InsertBlob reads r until EOF and stores its content at stem, split in
+// chunks with the same framing as code. Chunks are written at sequential
+// suffixes, starting at 0, and continue in the leaves at the stems
+// returned by blobStem once a leaf is full. Each leaf is written in one
+// go. It returns the number of chunks written; if reading r fails, the
+// leaves that have already been written are kept.
+func (n *InternalNode) InsertBlob(stem []byte, r io.Reader, resolver NodeResolverFn) (int, error) {
+	if len(stem) != StemSize {
+		return 0, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+
+	var (
+		buf    = make([]byte, NodeWidth*CodeChunkSize)
+		chunks int
+	)
+	for index := uint64(0); ; index++ {
+		read, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return chunks, fmt.Errorf("reading blob: %w", err)
+		}
+
+		values := make([][]byte, NodeWidth)
+		count := copy(values, chunkifyCode(buf[:read]))
+		// If the last chunk is full, or if there is none, write an
+		// empty chunk after it so that chunks left over by a previous,
+		// longer, blob are ignored.
+		if count < NodeWidth && read%CodeChunkSize == 0 {
+			values[count] = make([]byte, LeafValueSize)
+		}
+		if err := n.InsertValuesAtStem(blobStem(stem, index), values, resolver); err != nil {
+			return chunks, err
+		}
+		chunks += count
+
+		if read < len(buf) {
+			return chunks, nil
+		}
+	}
+}
+
+// ReadBlob writes the blob that has been stored at stem by InsertBlob to
+// w. Nothing is written if no blob is present.
+func (n *InternalNode) ReadBlob(stem []byte, w io.Writer, resolver NodeResolverFn) error {
+	if len(stem) != StemSize {
+		return fmt.Errorf("invalid stem length %d", len(stem))
+	}
+
+	for index := uint64(0); ; index++ {
+		values, err := n.GetValuesAtStem(blobStem(stem, index), resolver)
+		if err != nil {
+			return err
+		}
+		if values == nil {
+			return nil
+		}
+		for _, chunk := range values {
+			data, last, err := decodeChunk(chunk)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return fmt.Errorf("writing blob: %w", err)
+			}
+			if last {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+)
+
+func TestInsertReadBlob(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	leafSize := NodeWidth * CodeChunkSize
+	for _, size := range []int{0, 1, CodeChunkSize, CodeChunkSize + 1, leafSize - 1, leafSize, leafSize + 1, 3*leafSize + 100} {
+		root := New().(*InternalNode)
+		blob := make([]byte, size)
+		for i := range blob {
+			blob[i] = byte(i * 7)
+		}
+		// Use a reader that returns one byte at a time, to check
+		// that short reads are handled.
+		chunks, err := root.InsertBlob(stem, iotest.OneByteReader(bytes.NewReader(blob)), nil)
+		if err != nil {
+			t.Fatalf("inserting %d bytes: %v", size, err)
+		}
+		if expected := (size + CodeChunkSize - 1) / CodeChunkSize; chunks != expected {
+			t.Fatalf("invalid number of chunks for %d bytes: %d != %d", size, chunks, expected)
+		}
+
+		var got bytes.Buffer
+		if err := root.ReadBlob(stem, &got, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), blob) {
+			t.Fatalf("invalid blob for size %d", size)
+		}
+	}
+}
+
+func TestInsertBlobOverwriteWithShorterBlob(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	root := New().(*InternalNode)
+	if _, err := root.InsertBlob(stem, bytes.NewReader(bytes.Repeat([]byte{1}, 2*NodeWidth*CodeChunkSize)), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range [][]byte{bytes.Repeat([]byte{2}, NodeWidth*CodeChunkSize), bytes.Repeat([]byte{3}, CodeChunkSize), {}} {
+		if _, err := root.InsertBlob(stem, bytes.NewReader(blob), nil); err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if err := root.ReadBlob(stem, &got, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), blob) {
+			t.Fatalf("invalid blob after overwrite: got %d bytes, expected %d", got.Len(), len(blob))
+		}
+	}
+}
+
+func TestBlobErrors(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if _, err := root.InsertBlob(ffx32KeyTest, bytes.NewReader(nil), nil); err == nil {
+		t.Fatal("expected an error for an invalid stem length")
+	}
+	errRead := errors.New("read error")
+	if _, err := root.InsertBlob(ffx32KeyTest[:StemSize], iotest.ErrReader(errRead), nil); !errors.Is(err, errRead) {
+		t.Fatalf("expected %v, got %v", errRead, err)
+	}
+
+	var got bytes.Buffer
+	if err := root.ReadBlob(zeroKeyTest[:StemSize], &got, nil); err != nil || got.Len() != 0 {
+		t.Fatalf("expected no blob and no error, got %d bytes, %v", got.Len(), err)
+	}
+}
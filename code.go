@@ -0,0 +1,125 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import "fmt"
+
+const (
+	// CodeChunkSize is the number of code bytes stored in a single
+	// 32-byte leaf value, the first byte being used for framing.
+	CodeChunkSize = LeafValueSize - 1
+
+	// maxCodeChunksInLeaf is the number of code chunks that fit in
+	// the code area of a single leaf, starting at CodeOffset.
+	maxCodeChunksInLeaf = NodeWidth - CodeOffset
+)
+
+// chunkifyCode splits code into 32-byte leaf values. The first byte of
+// each chunk is the number of code bytes that it holds, so that the
+// code can be reassembled without knowing its length beforehand.
+func chunkifyCode(code []byte) [][]byte {
+	chunks := make([][]byte, 0, (len(code)+CodeChunkSize-1)/CodeChunkSize)
+	for len(code) > 0 {
+		size := CodeChunkSize
+		if len(code) < size {
+			size = len(code)
+		}
+		chunk := make([]byte, LeafValueSize)
+		chunk[0] = byte(size)
+		copy(chunk[1:], code[:size])
+		chunks = append(chunks, chunk)
+		code = code[size:]
+	}
+	return chunks
+}
+
+// InsertCode splits code into chunks and writes them at sequential
+// suffixes of the stem, starting at CodeOffset. All chunks are written
+// in one go, so the leaf commitment is only updated once. The code must
+// fit in the code area of a single leaf.
+func (n *InternalNode) InsertCode(stem []byte, code []byte, resolver NodeResolverFn) error {
+	if len(stem) != StemSize {
+		return fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	chunks := chunkifyCode(code)
+	if len(chunks) > maxCodeChunksInLeaf {
+		return fmt.Errorf("code is too large to fit in a leaf: %d chunks > %d", len(chunks), maxCodeChunksInLeaf)
+	}
+
+	values := make([][]byte, NodeWidth)
+	for i, chunk := range chunks {
+		values[CodeOffset+i] = chunk
+	}
+	// If there is no chunk or the last chunk is full, write an empty
+	// chunk after it so that chunks left over by a previous, longer,
+	// code are ignored.
+	if len(chunks) < maxCodeChunksInLeaf && (len(chunks) == 0 || chunks[len(chunks)-1][0] == CodeChunkSize) {
+		values[CodeOffset+len(chunks)] = make([]byte, LeafValueSize)
+	}
+	return n.InsertValuesAtStem(stem, values, resolver)
+}
+
+// GetCode reassembles the code that has been written at the stem by
+// InsertCode. It returns nil if no code is present.
+func (n *InternalNode) GetCode(stem []byte, resolver NodeResolverFn) ([]byte, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	values, err := n.GetValuesAtStem(stem, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		return nil, nil
+	}
+
+	var code []byte
+	for _, chunk := range values[CodeOffset:] {
+		data, last, err := decodeChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+		code = append(code, data...)
+		if last {
+			break
+		}
+	}
+	return code, nil
+}
+
+// decodeChunk returns the bytes held by a chunk produced by
+// chunkifyCode, and whether it is the last chunk of the sequence:
+// either a missing value, or a chunk that isn't full.
+func decodeChunk(chunk []byte) (data []byte, last bool, err error) {
+	if len(chunk) == 0 {
+		return nil, true, nil
+	}
+	size := int(chunk[0])
+	if size > CodeChunkSize || size >= len(chunk) {
+		return nil, false, fmt.Errorf("invalid code chunk size %d", size)
+	}
+	return chunk[1 : 1+size], size < CodeChunkSize, nil
+}
@@ -0,0 +1,103 @@
+package verkle
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInsertGetCode(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	for _, size := range []int{1, CodeChunkSize - 1, CodeChunkSize, CodeChunkSize + 1, 10 * CodeChunkSize, maxCodeChunksInLeaf * CodeChunkSize} {
+		root := New().(*InternalNode)
+		code := make([]byte, size)
+		for i := range code {
+			code[i] = byte(i)
+		}
+		if err := root.InsertCode(stem, code, nil); err != nil {
+			t.Fatalf("inserting %d bytes of code: %v", size, err)
+		}
+		got, err := root.GetCode(stem, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, code) {
+			t.Fatalf("invalid code for size %d: %x != %x", size, got, code)
+		}
+
+		// The commitment must be the same as a leaf created with
+		// all the chunks at once.
+		values := make([][]byte, NodeWidth)
+		copy(values[CodeOffset:], chunkifyCode(code))
+		if size%CodeChunkSize == 0 && size/CodeChunkSize < maxCodeChunksInLeaf {
+			values[CodeOffset+size/CodeChunkSize] = make([]byte, LeafValueSize)
+		}
+		leaf, err := NewLeafNode(stem, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !root.children[stem[0]].Commitment().Equal(leaf.Commitment()) {
+			t.Fatalf("invalid leaf commitment for size %d", size)
+		}
+	}
+}
+
+func TestInsertCodeOverwriteWithShorterCode(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	root := New().(*InternalNode)
+	if err := root.InsertCode(stem, bytes.Repeat([]byte{1}, 3*CodeChunkSize), nil); err != nil {
+		t.Fatal(err)
+	}
+	code := bytes.Repeat([]byte{2}, CodeChunkSize)
+	if err := root.InsertCode(stem, code, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := root.GetCode(stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, code) {
+		t.Fatalf("invalid code after overwrite: %x != %x", got, code)
+	}
+}
+
+func TestInsertCodeErrors(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.InsertCode(ffx32KeyTest, []byte{1}, nil); err == nil {
+		t.Fatal("expected an error for an invalid stem length")
+	}
+	if err := root.InsertCode(ffx32KeyTest[:StemSize], make([]byte, maxCodeChunksInLeaf*CodeChunkSize+1), nil); err == nil {
+		t.Fatal("expected an error for code that doesn't fit in a leaf")
+	}
+	code, err := root.GetCode(ffx32KeyTest[:StemSize], nil)
+	if err != nil || code != nil {
+		t.Fatalf("expected no code and no error, got %x, %v", code, err)
+	}
+}
+
+func TestInsertCodeOverwriteWithEmptyCode(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	for _, empty := range [][]byte{nil, {}} {
+		root := New().(*InternalNode)
+		if err := root.InsertCode(stem, bytes.Repeat([]byte{1}, 3*CodeChunkSize), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.InsertCode(stem, empty, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := root.GetCode(stem, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("the previous code is still readable after writing empty code: %x", got)
+		}
+	}
+}
@@ -26,9 +26,11 @@
 package verkle
 
 import (
-	"encoding/hex"
+	"errors"
+	"fmt"
 	"sync"
 
+	"github.com/crate-crypto/go-ipa/common"
 	"github.com/crate-crypto/go-ipa/ipa"
 )
 
@@ -71,12 +73,15 @@ func GetConfig() *Config {
 		if err != nil {
 			panic(err)
 		}
-		cfg = &IPAConfig{conf: conf}
+		c := &IPAConfig{conf: conf}
+		if err := c.Validate(); err != nil {
+			panic(err)
+		}
+		cfg = c
 
 		// Initialize the empty code cached values.
-		emptyHashCode, _ := hex.DecodeString("c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470")
 		values := make([][]byte, NodeWidth)
-		values[CodeHashVectorPosition] = emptyHashCode
+		values[CodeHashVectorPosition] = EmptyCodeHash[:]
 		var c1poly [NodeWidth]Fr
 		if _, err := fillSuffixTreePoly(c1poly[:], values[:NodeWidth/2]); err != nil {
 			panic(err)
@@ -88,7 +93,67 @@ func GetConfig() *Config {
 	return cfg
 }
 
+// Validate checks that the configuration can commit to node polynomials,
+// so that a misconfigured SRS is reported upfront rather than causing an
+// index out of range panic while committing.
+func (conf *IPAConfig) Validate() error {
+	if conf.conf == nil {
+		return errors.New("missing IPA settings")
+	}
+	if len(conf.conf.SRS) < NodeWidth {
+		return fmt.Errorf("SRS is too short for the node width: %d < %d", len(conf.conf.SRS), NodeWidth)
+	}
+	if conf.conf.PrecomputedWeights == nil {
+		return errors.New("missing precomputed barycentric weights")
+	}
+	return nil
+}
+
 func (conf *IPAConfig) CommitToPoly(poly []Fr, _ int) *Point {
 	ret := conf.conf.Commit(poly)
 	return &ret
 }
+
+// OpenAt evaluates a polynomial, given in evaluation form over the
+// domain [0, NodeWidth) like node polynomials are, at an arbitrary
+// point z, and proves that evaluation against the commitment of the
+// polynomial. Points outside of the domain are evaluated with the
+// barycentric formula. The proof is checked with VerifyOpening.
+func (conf *IPAConfig) OpenAt(poly []Fr, z *Fr) (*Fr, *ipa.IPAProof, error) {
+	if len(poly) != NodeWidth {
+		return nil, nil, fmt.Errorf("invalid polynomial length, expected %d, got %d", NodeWidth, len(poly))
+	}
+
+	y, err := conf.evaluate(poly, z)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := ipa.CreateIPAProof(common.NewTranscript("vt"), conf.conf, conf.conf.Commit(poly), poly, *z)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating the opening proof: %w", err)
+	}
+	return y, &proof, nil
+}
+
+// VerifyOpening checks a proof produced by OpenAt, that the polynomial
+// committed to in comm evaluates to y at z.
+func (conf *IPAConfig) VerifyOpening(comm *Point, z, y *Fr, proof *ipa.IPAProof) (bool, error) {
+	return ipa.CheckIPAProof(common.NewTranscript("vt"), conf.conf, *comm, *proof, *z, *y)
+}
+
+// evaluate returns the value at z of a polynomial in evaluation form.
+func (conf *IPAConfig) evaluate(poly []Fr, z *Fr) (*Fr, error) {
+	var point Fr
+	for i := range poly {
+		point.SetUint64(uint64(i))
+		if point.Equal(z) {
+			return new(Fr).Set(&poly[i]), nil
+		}
+	}
+
+	y, err := ipa.InnerProd(poly, conf.conf.PrecomputedWeights.ComputeBarycentricCoefficients(*z))
+	if err != nil {
+		return nil, fmt.Errorf("evaluating the polynomial: %w", err)
+	}
+	return &y, nil
+}
@@ -0,0 +1,73 @@
+package verkle
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crate-crypto/go-ipa/ipa"
+)
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	conf := GetConfig()
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("the default configuration is invalid: %v", err)
+	}
+
+	short := *conf.conf
+	short.SRS = short.SRS[:NodeWidth-1]
+	err := (&IPAConfig{conf: &short}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "SRS is too short") {
+		t.Fatalf("expected an error for a short SRS, got %v", err)
+	}
+
+	if err := (&IPAConfig{conf: &ipa.IPAConfig{SRS: conf.conf.SRS}}).Validate(); err == nil {
+		t.Fatal("expected an error for missing barycentric weights")
+	}
+	if err := (&IPAConfig{}).Validate(); err == nil {
+		t.Fatal("expected an error for missing IPA settings")
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	t.Parallel()
+
+	// p(x) = 3x + 5, in evaluation form over the domain.
+	poly := make([]Fr, NodeWidth)
+	for i := range poly {
+		poly[i].SetUint64(uint64(3*i + 5))
+	}
+	conf := GetConfig()
+	comm := conf.CommitToPoly(poly, 0)
+
+	for _, z := range []uint64{0, 7, NodeWidth - 1, NodeWidth, 1000} {
+		var point, expected Fr
+		point.SetUint64(z)
+		expected.SetUint64(3*z + 5)
+
+		y, proof, err := conf.OpenAt(poly, &point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !y.Equal(&expected) {
+			t.Fatalf("invalid evaluation at %d", z)
+		}
+		if ok, err := conf.VerifyOpening(comm, &point, y, proof); !ok || err != nil {
+			t.Fatalf("could not verify the opening at %d: %v", z, err)
+		}
+
+		var wrong Fr
+		wrong.Add(y, &FrOne)
+		if ok, _ := conf.VerifyOpening(comm, &point, &wrong, proof); ok {
+			t.Fatalf("verified a wrong evaluation at %d", z)
+		}
+		if ok, _ := conf.VerifyOpening(conf.CommitToPoly(poly[:1], 0), &point, y, proof); ok {
+			t.Fatalf("verified an opening at %d against the wrong commitment", z)
+		}
+	}
+
+	if _, _, err := conf.OpenAt(poly[:NodeWidth-1], new(Fr)); err == nil {
+		t.Fatal("expected an error for a polynomial of the wrong length")
+	}
+}
@@ -25,6 +25,11 @@
 
 package verkle
 
+import (
+	"bytes"
+	"fmt"
+)
+
 // A few proxy types that export their fields, so that the core type
 // does not. The conversion from one type to the other is done by calling
 // toExportable on an InternalNode.
@@ -44,3 +49,101 @@ type (
 		C2 [32]byte `json:"c2"`
 	}
 )
+
+// RootDiff describes the first point at which two trees diverge, as
+// found by CompareRoots.
+type RootDiff struct {
+	// Path is the path to the divergent nodes. If the divergence is a
+	// value, it is the full key of the value.
+	Path []byte
+
+	// A and B are the divergent nodes of each tree.
+	A, B VerkleNode
+
+	// Reason is a human-readable description of the divergence.
+	Reason string
+}
+
+func (d *RootDiff) String() string {
+	return fmt.Sprintf("trees diverge at path %x: %s (%T %s vs %T %s)", d.Path, d.Reason, d.A, commitmentString(d.A), d.B, commitmentString(d.B))
+}
+
+// commitmentString returns the commitment of a node, or a placeholder
+// for nodes that don't have one.
+func commitmentString(n VerkleNode) string {
+	if _, ok := n.(HashedNode); ok {
+		return "<hashed>"
+	}
+	return fmt.Sprintf("%x", n.Commitment().Bytes())
+}
+
+// CompareRoots walks two committed trees in lockstep and returns the
+// first divergence, in path order, that explains why their commitments
+// differ. It returns nil if both trees have the same commitment. Hashed
+// nodes can not be descended into, so the path to a hashed node, on
+// either side, is only reported if no other divergence is found.
+func CompareRoots(a, b VerkleNode) (*RootDiff, error) {
+	return compareNodes(nil, a, b)
+}
+
+func compareNodes(path []byte, a, b VerkleNode) (*RootDiff, error) {
+	_, aHashed := a.(HashedNode)
+	_, bHashed := b.(HashedNode)
+	if aHashed || bHashed {
+		return &RootDiff{Path: path, A: a, B: b, Reason: "hashed node can not be compared"}, nil
+	}
+	if a.Commitment().Equal(b.Commitment()) {
+		return nil, nil
+	}
+
+	switch an := a.(type) {
+	case *InternalNode:
+		bn, ok := b.(*InternalNode)
+		if !ok {
+			return &RootDiff{Path: path, A: a, B: b, Reason: "different node types"}, nil
+		}
+		var hashed *RootDiff
+		for i := range an.children {
+			childPath := append(path[:len(path):len(path)], byte(i))
+			ac, bc := an.children[i], bn.children[i]
+			_, aHashed := ac.(HashedNode)
+			_, bHashed := bc.(HashedNode)
+			if aHashed || bHashed {
+				// Keep looking for a divergence that can be
+				// explained, and only report this one if there
+				// is none.
+				if hashed == nil {
+					hashed = &RootDiff{Path: childPath, A: ac, B: bc, Reason: "hashed node can not be compared"}
+				}
+				continue
+			}
+			diff, err := compareNodes(childPath, ac, bc)
+			if err != nil || diff != nil {
+				return diff, err
+			}
+		}
+		if hashed != nil {
+			return hashed, nil
+		}
+		return &RootDiff{Path: path, A: a, B: b, Reason: "children are identical but commitments differ"}, nil
+	case *LeafNode:
+		bn, ok := b.(*LeafNode)
+		if !ok {
+			return &RootDiff{Path: path, A: a, B: b, Reason: "different node types"}, nil
+		}
+		if !equalPaths(an.stem, bn.stem) {
+			return &RootDiff{Path: path, A: a, B: b, Reason: fmt.Sprintf("different stems %x and %x", an.stem, bn.stem)}, nil
+		}
+		for i := range an.values {
+			if !bytes.Equal(an.values[i], bn.values[i]) {
+				key := append(append([]byte{}, an.stem...), byte(i))
+				return &RootDiff{Path: key, A: a, B: b, Reason: fmt.Sprintf("different values %x and %x", an.values[i], bn.values[i])}, nil
+			}
+		}
+		return &RootDiff{Path: path, A: a, B: b, Reason: "values are identical but commitments differ"}, nil
+	case Empty, UnknownNode:
+		return &RootDiff{Path: path, A: a, B: b, Reason: "different node types"}, nil
+	default:
+		return nil, errUnknownNodeType
+	}
+}
@@ -26,6 +26,8 @@
 package verkle
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -54,3 +56,86 @@ func TestJSON(t *testing.T) {
 	}
 	t.Log(string(output))
 }
+
+func TestCompareRoots(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeysSorted(t, 50)
+	build := func() *InternalNode {
+		root := New().(*InternalNode)
+		for _, key := range keys {
+			if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root.Commit()
+		return root
+	}
+
+	a, b := build(), build()
+	diff, err := CompareRoots(a, b)
+	if err != nil || diff != nil {
+		t.Fatalf("identical trees should not diverge: %v, %v", diff, err)
+	}
+
+	// Divergent value.
+	if err := b.Insert(keys[10], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Commit()
+	diff, err = CompareRoots(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || !bytes.Equal(diff.Path, keys[10]) || !strings.Contains(diff.Reason, "different values") {
+		t.Fatalf("invalid diff for a divergent value: %v", diff)
+	}
+	if _, ok := diff.A.(*LeafNode); !ok || !strings.Contains(diff.String(), "*verkle.LeafNode") {
+		t.Fatalf("invalid diff description: %v", diff)
+	}
+
+	// Missing subtree.
+	b = build()
+	if _, err := b.Delete(keys[20], nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Commit()
+	diff, err = CompareRoots(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || !bytes.Equal(diff.Path, keys[20][:len(diff.Path)]) || diff.Reason != "different node types" {
+		t.Fatalf("invalid diff for a missing subtree: %v", diff)
+	}
+	if _, ok := diff.B.(Empty); !ok {
+		t.Fatalf("expected an empty node on the right side, got %T", diff.B)
+	}
+
+	// Hashed nodes are only reported if no other divergence is found.
+	b = build()
+	if err := b.Insert(keys[49], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Commit()
+	a.children[keys[0][0]] = HashedNode{}
+	diff, err = CompareRoots(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || !bytes.Equal(diff.Path, keys[49]) {
+		t.Fatalf("invalid diff with a hashed node: %v", diff)
+	}
+	a, b = build(), build()
+	b.children[keys[1][0]] = HashedNode{}
+	if err := a.Insert(keys[1], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Commit()
+	diff, err = CompareRoots(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || !bytes.Equal(diff.Path, keys[1][:1]) || !strings.Contains(diff.Reason, "hashed") {
+		t.Fatalf("expected the hashed node to be reported, got %v", diff)
+	}
+}
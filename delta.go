@@ -0,0 +1,259 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// deltaDeleted is the length byte that marks a deleted value in a delta,
+// as values are never longer than LeafValueSize.
+const deltaDeleted = 0xff
+
+// deltaHeaderSize is the size of the commitments of the old and new roots
+// at the start of a delta.
+const deltaHeaderSize = 2 * 32
+
+var errInvalidDelta = errors.New("invalid delta")
+
+// ComputeDelta returns a binary patch that turns the tree rooted at old
+// into the tree rooted at updated. Both trees are committed, and subtrees
+// whose commitment is the same in both are skipped. The delta starts
+// with the serialized commitments of the old and new roots, followed by
+// one record per stem whose values changed, in stem order:
+//
+//	stem (31 bytes) | count - 1 (1 byte) | count * (suffix | length | value)
+//
+// where a length of 0xff marks a deleted value. Commitments aren't part
+// of the delta, as ApplyDelta recomputes them. Both trees must be fully
+// in memory along the paths that differ.
+func ComputeDelta(old, updated VerkleNode) ([]byte, error) {
+	oldRoot, ok := old.(*InternalNode)
+	if !ok {
+		return nil, errors.New("the old tree isn't rooted at an internal node")
+	}
+	newRoot, ok := updated.(*InternalNode)
+	if !ok {
+		return nil, errors.New("the new tree isn't rooted at an internal node")
+	}
+
+	oldC, newC := oldRoot.Commit().Bytes(), newRoot.Commit().Bytes()
+	delta := make([]byte, 0, deltaHeaderSize)
+	delta = append(delta, oldC[:]...)
+	delta = append(delta, newC[:]...)
+	return appendDelta(delta, oldRoot, newRoot)
+}
+
+// appendDelta appends the records of the stems that differ between the
+// old and updated subtrees, which are located at the same path.
+func appendDelta(delta []byte, old, updated VerkleNode) ([]byte, error) {
+	oldInternal, oldIsInternal := old.(*InternalNode)
+	newInternal, newIsInternal := updated.(*InternalNode)
+	if oldIsInternal && newIsInternal {
+		var err error
+		for i := range oldInternal.children {
+			oldChild, newChild := oldInternal.children[i], newInternal.children[i]
+			if sameSubtree(oldChild, newChild) {
+				continue
+			}
+			if delta, err = appendDelta(delta, oldChild, newChild); err != nil {
+				return nil, err
+			}
+		}
+		return delta, nil
+	}
+
+	// The subtrees have a different shape, e.g. a leaf was split into an
+	// internal node by an insertion. As one of them holds at most one
+	// leaf, diff their leaves directly.
+	oldLeaves, err := collectLeaves(old, nil)
+	if err != nil {
+		return nil, err
+	}
+	newLeaves, err := collectLeaves(updated, nil)
+	if err != nil {
+		return nil, err
+	}
+	for len(oldLeaves) > 0 || len(newLeaves) > 0 {
+		switch {
+		case len(newLeaves) == 0 || (len(oldLeaves) > 0 && bytes.Compare(oldLeaves[0].stem, newLeaves[0].stem) < 0):
+			delta = appendStemDelta(delta, oldLeaves[0].stem, oldLeaves[0].values, nil)
+			oldLeaves = oldLeaves[1:]
+		case len(oldLeaves) == 0 || bytes.Compare(oldLeaves[0].stem, newLeaves[0].stem) > 0:
+			delta = appendStemDelta(delta, newLeaves[0].stem, nil, newLeaves[0].values)
+			newLeaves = newLeaves[1:]
+		default:
+			delta = appendStemDelta(delta, newLeaves[0].stem, oldLeaves[0].values, newLeaves[0].values)
+			oldLeaves, newLeaves = oldLeaves[1:], newLeaves[1:]
+		}
+	}
+	return delta, nil
+}
+
+// sameSubtree reports whether two committed subtrees located at the same
+// path are known to hold the same values.
+func sameSubtree(old, updated VerkleNode) bool {
+	switch old := old.(type) {
+	case Empty:
+		_, ok := updated.(Empty)
+		return ok
+	case *InternalNode:
+		newInternal, ok := updated.(*InternalNode)
+		return ok && (old == newInternal || old.Commitment().Equal(newInternal.Commitment()))
+	case *LeafNode:
+		newLeaf, ok := updated.(*LeafNode)
+		return ok && (old == newLeaf || old.Commitment().Equal(newLeaf.Commitment()))
+	default:
+		return false
+	}
+}
+
+// collectLeaves appends the leaves of the subtree rooted at n, in stem order.
+func collectLeaves(n VerkleNode, leaves []*LeafNode) ([]*LeafNode, error) {
+	switch n := n.(type) {
+	case Empty:
+		return leaves, nil
+	case *LeafNode:
+		return append(leaves, n), nil
+	case *InternalNode:
+		var err error
+		for _, child := range n.children {
+			if leaves, err = collectLeaves(child, leaves); err != nil {
+				return nil, err
+			}
+		}
+		return leaves, nil
+	case HashedNode:
+		return nil, fmt.Errorf("computing a delta: %w", errReadFromInvalid)
+	case UnknownNode:
+		return nil, fmt.Errorf("computing a delta: %w", errMissingNodeInStateless)
+	default:
+		return nil, errUnknownNodeType
+	}
+}
+
+// appendStemDelta appends the record turning the old values of a stem into
+// the new ones, if they differ. A nil slice stands for a missing leaf.
+func appendStemDelta(delta, stem []byte, oldValues, newValues [][]byte) []byte {
+	var (
+		entries []byte
+		count   int
+	)
+	for i := 0; i < NodeWidth; i++ {
+		var oldValue, newValue []byte
+		if oldValues != nil {
+			oldValue = oldValues[i]
+		}
+		if newValues != nil {
+			newValue = newValues[i]
+		}
+		// Empty values are treated as missing, like the leaf
+		// commitment does.
+		switch {
+		case len(oldValue) == 0 && len(newValue) == 0:
+			continue
+		case len(newValue) == 0:
+			entries = append(entries, byte(i), deltaDeleted)
+		case bytes.Equal(oldValue, newValue):
+			continue
+		default:
+			entries = append(entries, byte(i), byte(len(newValue)))
+			entries = append(entries, newValue...)
+		}
+		count++
+	}
+	if count == 0 {
+		return delta
+	}
+	delta = append(delta, stem...)
+	delta = append(delta, byte(count-1))
+	return append(delta, entries...)
+}
+
+// ApplyDelta applies a delta produced by ComputeDelta to a copy of the
+// tree rooted at old, which is left untouched, and returns the copy. An
+// error is returned if old isn't the tree that the delta was computed
+// from, or if the commitment of the result isn't that of the new tree.
+// Since nodes aren't collapsed upon deletion, the latter can happen if
+// the new tree was built independently from old, and its shape differs from
+// that obtained by deleting values from old.
+func ApplyDelta(old VerkleNode, delta []byte) (VerkleNode, error) {
+	root, ok := old.(*InternalNode)
+	if !ok {
+		return nil, errors.New("the old tree isn't rooted at an internal node")
+	}
+	if len(delta) < deltaHeaderSize {
+		return nil, fmt.Errorf("%w: truncated header", errInvalidDelta)
+	}
+	if oldC := root.Commit().Bytes(); !bytes.Equal(oldC[:], delta[:32]) {
+		return nil, fmt.Errorf("delta applies to root %x, not %x", delta[:32], oldC)
+	}
+
+	ret := root.Copy().(*InternalNode)
+	for rest := delta[deltaHeaderSize:]; len(rest) > 0; {
+		if len(rest) < StemSize+1 {
+			return nil, fmt.Errorf("%w: truncated stem record", errInvalidDelta)
+		}
+		stem := rest[:StemSize]
+		count := int(rest[StemSize]) + 1
+		rest = rest[StemSize+1:]
+
+		values := make([][]byte, NodeWidth)
+		var inserted bool
+		for j := 0; j < count; j++ {
+			if len(rest) < 2 {
+				return nil, fmt.Errorf("%w: truncated entry for stem %x", errInvalidDelta, stem)
+			}
+			suffix, length := rest[0], int(rest[1])
+			rest = rest[2:]
+			if length == deltaDeleted {
+				key := append(append(make([]byte, 0, StemSize+1), stem...), suffix)
+				if _, err := ret.Delete(key, nil); err != nil {
+					return nil, fmt.Errorf("deleting key %x: %w", key, err)
+				}
+				continue
+			}
+			if length > LeafValueSize || len(rest) < length {
+				return nil, fmt.Errorf("%w: invalid value length %d for key %x%02x", errInvalidDelta, length, stem, suffix)
+			}
+			values[suffix] = append([]byte{}, rest[:length]...)
+			rest = rest[length:]
+			inserted = true
+		}
+		if inserted {
+			if err := ret.InsertValuesAtStem(stem, values, nil); err != nil {
+				return nil, fmt.Errorf("inserting values at stem %x: %w", stem, err)
+			}
+		}
+	}
+
+	if newC := ret.Commit().Bytes(); !bytes.Equal(newC[:], delta[32:deltaHeaderSize]) {
+		return nil, fmt.Errorf("delta produced root %x, expected %x", newC, delta[32:deltaHeaderSize])
+	}
+	return ret, nil
+}
@@ -0,0 +1,198 @@
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestComputeApplyDelta(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 200)
+	old := New().(*InternalNode)
+	for _, key := range keys {
+		if err := old.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldC := *old.Commit()
+
+	// Update, delete and insert values, including a key whose stem is
+	// a sibling of an existing one, so that a leaf gets split.
+	updated := old.Copy().(*InternalNode)
+	if err := updated.Insert(keys[0], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updated.Delete(keys[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	sibling := append([]byte{}, keys[2]...)
+	sibling[StemSize-1] ^= 1
+	for _, key := range [][]byte{sibling, zeroKeyTest, ffx32KeyTest} {
+		if err := updated.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extra := append([]byte{}, keys[3]...)
+	extra[StemSize]++
+	if err := updated.Insert(extra, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	delta, err := ComputeDelta(old, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := ApplyDelta(old, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applied.Commit().Equal(updated.Commit()) {
+		t.Fatal("the delta doesn't produce the updated tree")
+	}
+	appliedMap, err := applied.(*InternalNode).ToMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMap, err := updated.ToMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appliedMap) != len(newMap) {
+		t.Fatalf("invalid number of values: %d != %d", len(appliedMap), len(newMap))
+	}
+	for key, value := range newMap {
+		if !bytes.Equal(appliedMap[key], value) {
+			t.Fatalf("invalid value for key %x: %x != %x", key, appliedMap[key], value)
+		}
+	}
+	if !old.Commit().Equal(&oldC) {
+		t.Fatal("applying the delta modified the old tree")
+	}
+
+	// Deltas only carry the values that changed: one in each of the six
+	// modified stems.
+	if maxSize := deltaHeaderSize + 6*(StemSize+1+2+LeafValueSize); len(delta) > maxSize {
+		t.Fatalf("delta is too large: %d > %d bytes", len(delta), maxSize)
+	}
+}
+
+func TestApplyDeltaKeepsMissingValues(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 20)
+	old, expected := New().(*InternalNode), New().(*InternalNode)
+	for _, key := range keys[:10] {
+		if err := old.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		if err := expected.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	delta, err := ComputeDelta(old, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := ApplyDelta(old, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Suffixes that were never set are still missing, both in leaves
+	// that the delta left untouched and in those it created.
+	for _, key := range [][]byte{keys[0], keys[15]} {
+		absent := append([]byte{}, key...)
+		absent[StemSize]++
+		value, err := applied.Get(absent, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != nil {
+			t.Fatalf("expected no value for key %x, got %x", absent, value)
+		}
+	}
+
+	appliedNodes, err := applied.(*InternalNode).BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNodes, err := expected.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appliedNodes) != len(expectedNodes) {
+		t.Fatalf("invalid number of serialized nodes: %d != %d", len(appliedNodes), len(expectedNodes))
+	}
+	for i := range expectedNodes {
+		if !bytes.Equal(appliedNodes[i].Path, expectedNodes[i].Path) {
+			t.Fatalf("invalid path for node %d: %x != %x", i, appliedNodes[i].Path, expectedNodes[i].Path)
+		}
+		if !bytes.Equal(appliedNodes[i].SerializedBytes, expectedNodes[i].SerializedBytes) {
+			t.Fatalf("serialized node at path %x differs", expectedNodes[i].Path)
+		}
+	}
+}
+
+func TestDeltaBetweenIdenticalTrees(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range randomKeys(t, 50) {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delta, err := ComputeDelta(root, root.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta) != deltaHeaderSize {
+		t.Fatalf("expected an empty delta, got %d bytes", len(delta))
+	}
+	applied, err := ApplyDelta(root, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applied.Commit().Equal(root.Commit()) {
+		t.Fatal("an empty delta changed the tree")
+	}
+}
+
+func TestApplyDeltaErrors(t *testing.T) {
+	t.Parallel()
+
+	old := New().(*InternalNode)
+	if err := old.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	updated := old.Copy().(*InternalNode)
+	if err := updated.Insert(ffx32KeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	delta, err := ComputeDelta(old, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApplyDelta(updated, delta); err == nil {
+		t.Fatal("applied a delta to a tree it wasn't computed from")
+	}
+	for _, size := range []int{deltaHeaderSize - 1, deltaHeaderSize + StemSize, len(delta) - 1} {
+		if _, err := ApplyDelta(old, delta[:size]); !errors.Is(err, errInvalidDelta) {
+			t.Fatalf("expected %v for a delta truncated to %d bytes, got %v", errInvalidDelta, size, err)
+		}
+	}
+
+	// A delta whose values were tampered with doesn't produce the
+	// expected root.
+	tampered := append([]byte{}, delta...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := ApplyDelta(old, tampered); err == nil {
+		t.Fatal("applied a tampered delta")
+	}
+}
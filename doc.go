@@ -36,6 +36,11 @@ var (
 	errUnknownNodeType        = errors.New("unknown node type detected")
 	errMissingNodeInStateless = errors.New("trying to access a node that is missing from the stateless view")
 	errIsPOAStub              = errors.New("trying to read/write a proof of absence leaf node")
+	errDepthExceeded          = errors.New("maximum depth exceeded")
+
+	// ErrFrozen is returned when trying to modify a tree after Freeze
+	// has been called.
+	ErrFrozen = errors.New("trying to modify a frozen tree")
 )
 
 const (
@@ -28,6 +28,7 @@ package verkle
 import (
 	"errors"
 	"fmt"
+	"math/bits"
 
 	"github.com/crate-crypto/go-ipa/banderwagon"
 )
@@ -87,6 +88,36 @@ func ParseNode(serializedNode []byte, depth byte) (VerkleNode, error) {
 	}
 }
 
+// ValidateSerialized checks that the length of a serialized node matches
+// the one implied by its type and bitlist, without parsing the node or
+// deserializing its commitments. It is meant to reject malformed or
+// truncated payloads received from an untrusted source early.
+func ValidateSerialized(data []byte) error {
+	if len(data) < nodeTypeSize {
+		return errSerializedPayloadTooShort
+	}
+	switch data[nodeTypeOffset] {
+	case internalRLPType:
+		if len(data) != internalCommitmentOffset+banderwagon.UncompressedSize {
+			return fmt.Errorf("internal node payload has length %d, expected %d: %w", len(data), internalCommitmentOffset+banderwagon.UncompressedSize, ErrInvalidNodeEncoding)
+		}
+	case leafRLPType:
+		if len(data) < leafChildrenOffset {
+			return fmt.Errorf("leaf node payload has length %d, expected at least %d: %w", len(data), leafChildrenOffset, errSerializedPayloadTooShort)
+		}
+		var count int
+		for _, b := range data[leafBitlistOffset:leafCommitmentOffset] {
+			count += bits.OnesCount8(b)
+		}
+		if len(data)-leafChildrenOffset != count*LeafValueSize {
+			return fmt.Errorf("leaf node has %d values but a value section of %d bytes: %w", count, len(data)-leafChildrenOffset, ErrInvalidNodeEncoding)
+		}
+	default:
+		return ErrInvalidNodeEncoding
+	}
+	return nil
+}
+
 func parseLeafNode(serialized []byte, depth byte) (VerkleNode, error) {
 	bitlist := serialized[leafBitlistOffset : leafBitlistOffset+bitlistSize]
 	var values [NodeWidth][]byte
@@ -1,6 +1,10 @@
 package verkle
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
 
 	"github.com/crate-crypto/go-ipa/banderwagon"
@@ -58,3 +62,198 @@ func TestInvalidNodeEncoding(t *testing.T) {
 		t.Fatalf("invalid error, got %v, expected %v", err, ErrInvalidNodeEncoding)
 	}
 }
+
+func TestValidateSerialized(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(fourtyKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+	internal, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := root.(*InternalNode).children[0].Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSerialized(internal); err != nil {
+		t.Fatalf("valid internal node rejected: %v", err)
+	}
+	if err := ValidateSerialized(leaf); err != nil {
+		t.Fatalf("valid leaf node rejected: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, errSerializedPayloadTooShort},
+		{"unknown type", append([]byte{leafRLPType + internalRLPType}, internal[1:]...), ErrInvalidNodeEncoding},
+		{"truncated internal", internal[:len(internal)-1], ErrInvalidNodeEncoding},
+		{"extended internal", append(append([]byte{}, internal...), 0), ErrInvalidNodeEncoding},
+		{"truncated leaf header", leaf[:leafChildrenOffset-1], errSerializedPayloadTooShort},
+		{"truncated leaf values", leaf[:len(leaf)-LeafValueSize], ErrInvalidNodeEncoding},
+		{"partial leaf value", leaf[:len(leaf)-1], ErrInvalidNodeEncoding},
+		{"extra leaf value", append(append([]byte{}, leaf...), make([]byte, LeafValueSize)...), ErrInvalidNodeEncoding},
+	} {
+		if err := ValidateSerialized(tc.data); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// Setting an extra bit in the bitlist must be caught as well.
+	corrupted := append([]byte{}, leaf...)
+	corrupted[leafBitlistOffset+bitlistSize-1] |= 1
+	if err := ValidateSerialized(corrupted); !errors.Is(err, ErrInvalidNodeEncoding) {
+		t.Fatalf("expected %v, got %v", ErrInvalidNodeEncoding, err)
+	}
+}
+
+// assertRoundTripRoot serializes every node of a committed, fully in
+// memory, tree n and parses them back. The commitment of each node is
+// then recomputed from the parsed values, bottom-up, and compared to the
+// original one, so that a bug in the encoding can't hide behind the
+// commitments that it stores.
+func assertRoundTripRoot(n VerkleNode) error {
+	n.Commit()
+	_, err := roundTripCommitment(n, 0)
+	return err
+}
+
+func roundTripCommitment(n VerkleNode, depth byte) (*Point, error) {
+	serialized, err := n.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("serializing node at depth %d: %w", depth, err)
+	}
+	parsed, err := ParseNode(serialized, depth)
+	if err != nil {
+		return nil, fmt.Errorf("parsing node at depth %d: %w", depth, err)
+	}
+	if !parsed.Commitment().Equal(n.Commitment()) {
+		return nil, fmt.Errorf("stored commitment mismatch at depth %d: %x != %x", depth, parsed.Commitment().Bytes(), n.Commitment().Bytes())
+	}
+
+	var recomputed *Point
+	switch n := n.(type) {
+	case *LeafNode:
+		leaf, ok := parsed.(*LeafNode)
+		if !ok {
+			return nil, fmt.Errorf("leaf at depth %d parsed as %T", depth, parsed)
+		}
+		if !equalPaths(leaf.stem, n.stem) {
+			return nil, fmt.Errorf("stem mismatch at depth %d: %x != %x", depth, leaf.stem, n.stem)
+		}
+		fresh, err := NewLeafNode(leaf.stem, leaf.values)
+		if err != nil {
+			return nil, fmt.Errorf("recomputing leaf %x: %w", leaf.stem, err)
+		}
+		recomputed = fresh.Commitment()
+	case *InternalNode:
+		internal, ok := parsed.(*InternalNode)
+		if !ok {
+			return nil, fmt.Errorf("internal node at depth %d parsed as %T", depth, parsed)
+		}
+		var poly [NodeWidth]Fr
+		for i, child := range n.children {
+			_, empty := child.(Empty)
+			if _, parsedEmpty := internal.children[i].(Empty); empty != parsedEmpty {
+				return nil, fmt.Errorf("child %d at depth %d: presence mismatch after parsing", i, depth)
+			}
+			if empty {
+				continue
+			}
+			comm, err := roundTripCommitment(child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			comm.MapToScalarField(&poly[i])
+		}
+		recomputed = GetConfig().CommitToPoly(poly[:], 0)
+	default:
+		return nil, fmt.Errorf("can not round-trip a %T at depth %d", n, depth)
+	}
+
+	if !recomputed.Equal(n.Commitment()) {
+		return nil, fmt.Errorf("recomputed commitment mismatch at depth %d: %x != %x", depth, recomputed.Bytes(), n.Commitment().Bytes())
+	}
+	return recomputed, nil
+}
+
+func TestAssertRoundTripRootDetectsCorruption(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := assertRoundTripRoot(root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change a value behind the back of the leaf, so that its stored
+	// commitment no longer matches its values.
+	leaf := root.children[0xff].(*LeafNode)
+	leaf.values[ffx32KeyTest[StemSize]] = fourtyKeyTest
+	if err := assertRoundTripRoot(root); err == nil {
+		t.Fatal("expected a commitment mismatch")
+	}
+}
+
+// failingWriter fails once more than limit bytes have been written.
+type failingWriter struct {
+	limit int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, errWriteFailed
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestSerializeTo(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for i, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		// Values of different lengths, including an empty one.
+		if err := root.Insert(key, testValue[:8*i], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	nodes := []interface {
+		VerkleNode
+		SerializeTo(io.Writer) error
+	}{root, root.children[0].(*InternalNode), root.children[0].(*InternalNode).children[0].(*LeafNode), root.children[0xff].(*LeafNode)}
+	for _, node := range nodes {
+		expected, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := node.SerializeTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("streamed serialization of %T differs:\n%x\n%x", node, buf.Bytes(), expected)
+		}
+
+		if err := node.SerializeTo(&failingWriter{limit: len(expected) - 1}); !errors.Is(err, errWriteFailed) {
+			t.Fatalf("expected %v, got %v", errWriteFailed, err)
+		}
+	}
+}
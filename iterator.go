@@ -0,0 +1,309 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// errIterationDone is used internally to stop the walk once a page is full.
+var errIterationDone = errors.New("iteration done")
+
+// IterateFrom returns up to limit key/value pairs, in key order, starting
+// at the first key that is greater than or equal to start. A nil start
+// iterates from the beginning of the tree. next is the key to pass as
+// start to get the following page; it is nil once the tree has been
+// exhausted. The cursor is stable as long as the tree isn't modified
+// between calls.
+//
+// Hashed nodes along the way are resolved with resolver, and replace
+// the hashed node in the tree, the same way Get does. IterateFrom must be
+// called on the root node, since the path of a node is needed to resolve
+// its children.
+func (n *InternalNode) IterateFrom(start []byte, limit int, resolver NodeResolverFn) (pairs [][2][]byte, next []byte, err error) {
+	if start != nil && len(start) != StemSize+1 {
+		return nil, nil, fmt.Errorf("invalid start key length %d", len(start))
+	}
+	if limit <= 0 {
+		return nil, nil, fmt.Errorf("invalid page size %d", limit)
+	}
+
+	pairs = make([][2][]byte, 0, limit)
+	visit := func(key, value []byte) error {
+		if len(pairs) == limit {
+			next = key
+			return errIterationDone
+		}
+		pairs = append(pairs, [2][]byte{key, value})
+		return nil
+	}
+	if n.depth != 0 {
+		return nil, nil, errors.New("iteration must start at the root node")
+	}
+	if err := n.iterateFrom(make([]byte, 0, StemSize), start, start != nil, visit, resolver); err != nil && err != errIterationDone {
+		return nil, nil, err
+	}
+	return pairs, next, nil
+}
+
+// iterateFrom walks the subtree rooted at n, whose path is path, in key
+// order. If bounded is true, path is a prefix of start, and the keys
+// that are lower than start are skipped.
+func (n *InternalNode) iterateFrom(path, start []byte, bounded bool, visit func(key, value []byte) error, resolver NodeResolverFn) error {
+	first := 0
+	if bounded {
+		first = int(start[n.depth])
+	}
+	for i := first; i < NodeWidth; i++ {
+		childPath := append(path, byte(i))
+		childBounded := bounded && i == first
+
+		child := n.children[i]
+		if _, ok := child.(HashedNode); ok {
+			if resolver == nil {
+				return fmt.Errorf("hashed node %x could not be resolved: %w", childPath, errReadFromInvalid)
+			}
+			serialized, err := resolver(childPath)
+			if err != nil {
+				return fmt.Errorf("resolving node %x: %w", childPath, err)
+			}
+			child, err = ParseNode(serialized, n.depth+1)
+			if err != nil {
+				return fmt.Errorf("verkle tree: error parsing resolved node %x: %w", childPath, err)
+			}
+			n.children[i] = child
+		}
+
+		switch child := child.(type) {
+		case Empty:
+		case UnknownNode:
+			return fmt.Errorf("iterating at %x: %w", childPath, errMissingNodeInStateless)
+		case *InternalNode:
+			if err := child.iterateFrom(childPath, start, childBounded, visit, resolver); err != nil {
+				return err
+			}
+		case *LeafNode:
+			if err := child.iterateFrom(start, childBounded, visit); err != nil {
+				return err
+			}
+		default:
+			return errUnknownNodeType
+		}
+	}
+	return nil
+}
+
+// iterateFrom visits the values of the leaf in suffix order. If bounded
+// is true, the values whose key is lower than start are skipped.
+func (n *LeafNode) iterateFrom(start []byte, bounded bool, visit func(key, value []byte) error) error {
+	if n.isPOAStub {
+		return errIsPOAStub
+	}
+	first := 0
+	if bounded {
+		switch bytes.Compare(n.stem, start[:StemSize]) {
+		case -1:
+			return nil
+		case 0:
+			first = int(start[StemSize])
+		}
+	}
+	for i := first; i < NodeWidth; i++ {
+		if n.values[i] == nil {
+			continue
+		}
+		key := make([]byte, StemSize+1)
+		copy(key, n.stem)
+		key[StemSize] = byte(i)
+		if err := visit(key, n.values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NearestKeys descends along the path of key for as long as it goes
+// through internal nodes, and returns the largest key <= key and the
+// smallest key >= key that are present in the subtree it ended up in.
+// That subtree is the one an absence proof for key refers to. nil is
+// returned when there is no such key. Hashed nodes are not resolved,
+// and cause an error.
+func (n *InternalNode) NearestKeys(key []byte) (predecessor, successor []byte, err error) {
+	if len(key) != StemSize+1 {
+		return nil, nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	node := n
+	for {
+		child, ok := node.children[offset2key(key, node.depth)].(*InternalNode)
+		if !ok {
+			break
+		}
+		node = child
+	}
+
+	predecessor, err = node.lastKeyUpTo(key, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := make([]byte, node.depth, StemSize)
+	copy(path, key)
+	err = node.iterateFrom(path, key, true, func(k, _ []byte) error {
+		successor = k
+		return errIterationDone
+	}, nil)
+	if err != nil && err != errIterationDone {
+		return nil, nil, err
+	}
+	return predecessor, successor, nil
+}
+
+// lastKeyUpTo returns the largest key in the subtree. If bounded is
+// true, the path to n is a prefix of key, and the keys greater than key
+// are ignored.
+func (n *InternalNode) lastKeyUpTo(key []byte, bounded bool) ([]byte, error) {
+	last := NodeWidth - 1
+	if bounded {
+		last = int(key[n.depth])
+	}
+	for i := last; i >= 0; i-- {
+		childBounded := bounded && i == last
+		switch child := n.children[i].(type) {
+		case Empty:
+		case *InternalNode:
+			found, err := child.lastKeyUpTo(key, childBounded)
+			if err != nil || found != nil {
+				return found, err
+			}
+		case *LeafNode:
+			found, err := child.lastKeyUpTo(key, childBounded)
+			if err != nil || found != nil {
+				return found, err
+			}
+		case HashedNode:
+			return nil, fmt.Errorf("hashed node at depth %d, index %d can not be searched: %w", n.depth+1, i, errReadFromInvalid)
+		case UnknownNode:
+			return nil, fmt.Errorf("NearestKeys at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+		default:
+			return nil, errUnknownNodeType
+		}
+	}
+	return nil, nil
+}
+
+func (n *LeafNode) lastKeyUpTo(key []byte, bounded bool) ([]byte, error) {
+	if n.isPOAStub {
+		return nil, errIsPOAStub
+	}
+	last := NodeWidth - 1
+	if bounded {
+		switch bytes.Compare(n.stem, key[:StemSize]) {
+		case 1:
+			return nil, nil
+		case 0:
+			last = int(key[StemSize])
+		}
+	}
+	for i := last; i >= 0; i-- {
+		if n.values[i] != nil {
+			found := make([]byte, StemSize+1)
+			copy(found, n.stem)
+			found[StemSize] = byte(i)
+			return found, nil
+		}
+	}
+	return nil, nil
+}
+
+// ToMap returns all the key/value pairs of the tree, indexed by
+// string(key). Values are copied. Hashed nodes can not be walked and
+// cause an error to be returned, so the tree must be fully in memory.
+func (n *InternalNode) ToMap() (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	if err := n.toMap(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (n *InternalNode) toMap(m map[string][]byte) error {
+	for i, child := range n.children {
+		switch child := child.(type) {
+		case Empty:
+		case *InternalNode:
+			if err := child.toMap(m); err != nil {
+				return err
+			}
+		case *LeafNode:
+			if child.isPOAStub {
+				return fmt.Errorf("leaf %x: %w", child.stem, errIsPOAStub)
+			}
+			for suffix, value := range child.values {
+				if value != nil {
+					m[string(child.Key(suffix))] = append([]byte{}, value...)
+				}
+			}
+		case HashedNode:
+			return fmt.Errorf("hashed node at depth %d, index %d can not be exported: %w", n.depth+1, i, errReadFromInvalid)
+		case UnknownNode:
+			return fmt.Errorf("ToMap at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+		default:
+			return errUnknownNodeType
+		}
+	}
+	return nil
+}
+
+// FromMap builds a tree holding the key/value pairs of m, indexed by
+// string(key) as returned by ToMap. Nil values are skipped. The values
+// of each stem are inserted at once, so that each leaf commitment is
+// only computed once.
+func FromMap(m map[string][]byte) (*InternalNode, error) {
+	stems := make(map[string][][]byte)
+	for key, value := range m {
+		if len(key) != StemSize+1 {
+			return nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+		}
+		if value == nil {
+			continue
+		}
+		values, ok := stems[key[:StemSize]]
+		if !ok {
+			values = make([][]byte, NodeWidth)
+			stems[key[:StemSize]] = values
+		}
+		values[key[StemSize]] = value
+	}
+
+	root := New().(*InternalNode)
+	for stem, values := range stems {
+		if err := root.InsertValuesAtStem([]byte(stem), values, nil); err != nil {
+			return nil, fmt.Errorf("inserting stem %x: %w", stem, err)
+		}
+	}
+	return root, nil
+}
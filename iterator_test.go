@@ -0,0 +1,238 @@
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestIterateFromPages(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 300)
+	// Add keys that share a stem, so that pages also split leaves.
+	for i := 0; i < 10; i++ {
+		key := append([]byte{}, keys[0]...)
+		key[StemSize] = byte(i)
+		keys = append(keys, key)
+	}
+	root := New().(*InternalNode)
+	expected := map[string][]byte{}
+	for i, key := range keys {
+		value := bytes.Repeat([]byte{byte(i)}, LeafValueSize)
+		if err := root.Insert(key, value, nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = value
+	}
+	sorted := make([]string, 0, len(expected))
+	for k := range expected {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	// Flush the tree and resolve it back while iterating, to check
+	// that hashed nodes are handled.
+	root.Commit()
+	db := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db[string(path)] = serialized
+	})
+	resolver := func(path []byte) ([]byte, error) {
+		return db[string(path)], nil
+	}
+
+	var (
+		got   []string
+		start []byte
+	)
+	for pages := 0; ; pages++ {
+		if pages > len(sorted) {
+			t.Fatal("too many pages")
+		}
+		pairs, next, err := root.IterateFrom(start, 7, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) > 7 {
+			t.Fatalf("page too large: %d", len(pairs))
+		}
+		for _, pair := range pairs {
+			if !bytes.Equal(pair[1], expected[string(pair[0])]) {
+				t.Fatalf("invalid value for key %x", pair[0])
+			}
+			got = append(got, string(pair[0]))
+		}
+		if next == nil {
+			break
+		}
+		start = next
+	}
+	if len(got) != len(sorted) {
+		t.Fatalf("invalid number of keys: %d != %d", len(got), len(sorted))
+	}
+	for i := range got {
+		if got[i] != sorted[i] {
+			t.Fatalf("invalid key order at %d: %x != %x", i, got[i], sorted[i])
+		}
+	}
+
+	// Starting at a key that isn't in the tree returns the next key.
+	start = append([]byte{}, sorted[5]...)
+	if start[StemSize] < 255 && expected[string(append(start[:StemSize:StemSize], start[StemSize]+1))] == nil {
+		start[StemSize]++
+		pairs, _, err := root.IterateFrom(start, 1, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 1 || string(pairs[0][0]) <= string(start) {
+			t.Fatalf("expected the first key after %x, got %x", start, pairs)
+		}
+	}
+}
+
+func TestIterateFromErrors(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if _, _, err := root.IterateFrom(zeroKeyTest[:StemSize], 1, nil); err == nil {
+		t.Fatal("expected an error for an invalid start key")
+	}
+	if _, _, err := root.IterateFrom(nil, 0, nil); err == nil {
+		t.Fatal("expected an error for an invalid page size")
+	}
+	pairs, next, err := root.IterateFrom(nil, 1, nil)
+	if err != nil || len(pairs) != 0 || next != nil {
+		t.Fatalf("expected an empty page, got %v %x %v", pairs, next, err)
+	}
+}
+
+func TestNearestKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeysSorted(t, 200)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Brute-force the expected result among the keys that are in the
+	// subtree where the descent stops.
+	check := func(query []byte) {
+		t.Helper()
+		node := root
+		for {
+			child, ok := node.children[query[node.depth]].(*InternalNode)
+			if !ok {
+				break
+			}
+			node = child
+		}
+		var pred, succ []byte
+		for _, key := range keys {
+			if !bytes.Equal(key[:node.depth], query[:node.depth]) {
+				continue
+			}
+			if bytes.Compare(key, query) <= 0 {
+				pred = key
+			}
+			if succ == nil && bytes.Compare(key, query) >= 0 {
+				succ = key
+			}
+		}
+		gotPred, gotSucc, err := root.NearestKeys(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotPred, pred) || !bytes.Equal(gotSucc, succ) {
+			t.Fatalf("invalid nearest keys for %x: got (%x, %x), expected (%x, %x)", query, gotPred, gotSucc, pred, succ)
+		}
+	}
+	for _, key := range keys[:20] {
+		check(key)
+		pred, succ, _ := root.NearestKeys(key)
+		if !bytes.Equal(pred, key) || !bytes.Equal(succ, key) {
+			t.Fatalf("a present key should be its own neighbour: %x, %x, %x", key, pred, succ)
+		}
+
+		// Same stem, different suffix.
+		query := append([]byte{}, key...)
+		query[StemSize] ^= 0x80
+		check(query)
+	}
+	for _, query := range randomKeys(t, 50) {
+		check(query)
+	}
+	check(zeroKeyTest)
+	check(ffx32KeyTest)
+
+	root.Commit()
+	for i, child := range root.children {
+		if _, ok := child.(Empty); !ok {
+			root.children[i] = HashedNode{}
+		}
+	}
+	if _, _, err := root.NearestKeys(keys[0]); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+}
+
+func TestToMapFromMap(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 300)
+	root := New().(*InternalNode)
+	for i, key := range keys {
+		if err := root.Insert(key, bytes.Repeat([]byte{byte(i)}, LeafValueSize), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two values in the same leaf, and an empty value.
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Insert(ffx32KeyTest, []byte{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := root.ToMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(keys)+3 {
+		t.Fatalf("invalid number of entries: %d != %d", len(m), len(keys)+3)
+	}
+	for i, key := range keys {
+		if !bytes.Equal(m[string(key)], bytes.Repeat([]byte{byte(i)}, LeafValueSize)) {
+			t.Fatalf("invalid value for key %x: %x", key, m[string(key)])
+		}
+	}
+	if value, ok := m[string(ffx32KeyTest)]; !ok || len(value) != 0 {
+		t.Fatalf("the empty value should be exported, got %x, %v", value, ok)
+	}
+
+	rebuilt, err := FromMap(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rebuilt.Commit().Equal(root.Commit()) {
+		t.Fatal("the tree rebuilt from the map has a different root commitment")
+	}
+
+	root.children[keys[0][0]] = HashedNode{}
+	if _, err := root.ToMap(); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+	if _, err := FromMap(map[string][]byte{"short": testValue}); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+}
@@ -123,6 +123,131 @@ func GetCommitmentsForMultiproof(root VerkleNode, keys [][]byte, resolver NodeRe
 	return root.GetProofItems(keylist(keys), resolver)
 }
 
+// ProofSize returns the number of openings that a multiproof for keys
+// will contain, without computing any polynomial or commitment. Openings
+// that are shared between keys, like those of the internal nodes along a
+// common path, are only counted once, as they are in GetProofItems. The
+// keys are not modified.
+func (n *InternalNode) ProofSize(keys [][]byte, resolver NodeResolverFn) (int, error) {
+	if len(keys) == 0 {
+		return 0, errors.New("no key provided for proof")
+	}
+	sorted := make(keylist, len(keys))
+	copy(sorted, keys)
+	sort.Sort(sorted)
+	return n.countOpenings(sorted, resolver)
+}
+
+func (n *InternalNode) countOpenings(keys keylist, resolver NodeResolverFn) (int, error) {
+	groups := groupKeys(keys, n.depth)
+	// One opening per child that is traversed.
+	openings := len(groups)
+	for _, group := range groups {
+		childIdx := offset2key(group[0], n.depth)
+		child := n.children[childIdx]
+		if _, ok := child.(HashedNode); ok {
+			childpath := make([]byte, n.depth+1)
+			copy(childpath, group[0][:n.depth])
+			childpath[n.depth] = childIdx
+			if resolver == nil {
+				return 0, fmt.Errorf("no resolver for path %x", childpath)
+			}
+			serialized, err := resolver(childpath)
+			if err != nil {
+				return 0, fmt.Errorf("error resolving for path %x: %w", childpath, err)
+			}
+			child, err = ParseNode(serialized, n.depth+1)
+			if err != nil {
+				return 0, err
+			}
+			n.children[childIdx] = child
+		}
+
+		switch child := child.(type) {
+		case Empty:
+		case UnknownNode:
+			return 0, fmt.Errorf("ProofSize at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+		case *InternalNode:
+			count, err := child.countOpenings(group, resolver)
+			if err != nil {
+				return 0, err
+			}
+			openings += count
+		case *LeafNode:
+			openings += child.countOpenings(group)
+		default:
+			return 0, errUnknownNodeType
+		}
+	}
+	return openings, nil
+}
+
+func (n *LeafNode) countOpenings(keys keylist) int {
+	// The marker and the stem are always opened.
+	openings := 2
+	var hasC1, hasC2 bool
+	suffixes := map[byte]struct{}{}
+	for _, key := range keys {
+		if !equalPaths(n.stem, key) {
+			continue
+		}
+		hasC1 = hasC1 || key[StemSize] < 128
+		hasC2 = hasC2 || key[StemSize] >= 128
+		suffixes[key[StemSize]] = struct{}{}
+	}
+	if hasC1 {
+		openings++
+	}
+	if hasC2 {
+		openings++
+	}
+	// Each value is opened as two 16-byte halves.
+	return openings + 2*len(suffixes)
+}
+
+// GetBatchWithProof commits to the tree, and returns the values of keys
+// along with the proof elements needed to prove them, in a single
+// traversal. Values are returned in the order of keys, and are nil for
+// absent keys. Commitments shared by several keys only appear once in
+// the proof elements, whose Vals follow the sorted order of keys as in
+// GetCommitmentsForMultiproof. keys is not modified.
+func (n *InternalNode) GetBatchWithProof(keys [][]byte, resolver NodeResolverFn) ([][]byte, *ProofElements, error) {
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no key provided for proof")
+	}
+	for _, key := range keys {
+		if len(key) != StemSize+1 {
+			return nil, nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+		}
+	}
+
+	// Sort a list of indices, so that the values can be put back in
+	// the order of keys.
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return bytes.Compare(keys[order[i]], keys[order[j]]) < 0 })
+	sorted := make(keylist, len(keys))
+	for i, idx := range order {
+		sorted[i] = keys[idx]
+	}
+
+	n.Commit()
+	pe, _, _, err := n.GetProofItems(sorted, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pe.Vals) != len(keys) {
+		return nil, nil, fmt.Errorf("invalid number of values in proof elements: %d != %d", len(pe.Vals), len(keys))
+	}
+	values := make([][]byte, len(keys))
+	for i, idx := range order {
+		values[idx] = pe.Vals[i]
+	}
+	return values, pe, nil
+}
+
 // getProofElementsFromTree factors the logic that is used both in the proving and verification methods. It takes a pre-state
 // tree and an optional post-state tree, extracts the proof data from them and returns all the items required to build/verify
 // a proof.
@@ -202,6 +327,214 @@ func MakeVerkleMultiProof(preroot, postroot VerkleNode, keys [][]byte, resolver
 	return proof, pe.Cis, pe.Zis, pe.Yis, nil
 }
 
+// ProveStemAbsent builds a proof that no leaf with the given stem is
+// present in the tree. The proof is that of the first key of the stem:
+// its extension status shows that the path of the stem either ends in
+// an empty node, or in a leaf with another stem, which means that none
+// of the 256 suffixes of the stem can be present. An error is returned
+// if the stem is present.
+func (n *InternalNode) ProveStemAbsent(stem []byte, resolver NodeResolverFn) (*Proof, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	leaf, err := n.getLeafAtStem(stem, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if leaf != nil {
+		return nil, fmt.Errorf("stem %x is present in the tree", stem)
+	}
+	n.Commit()
+	key := append(append(make([]byte, 0, StemSize+1), stem...), 0)
+	proof, _, _, _, err := MakeVerkleMultiProof(n, nil, [][]byte{key}, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// ProveSameLeaf builds a proof for two keys that are stored in the same
+// leaf, i.e. that share their stem, so that the openings of the path to
+// that leaf are only included once. An error is returned if the keys
+// have different stems, reporting the depth at which they diverge, or if
+// their stem isn't present in the tree.
+func (n *InternalNode) ProveSameLeaf(k1, k2 []byte, resolver NodeResolverFn) (*Proof, error) {
+	if len(k1) != StemSize+1 || len(k2) != StemSize+1 {
+		return nil, fmt.Errorf("invalid key lengths %d and %d, expected %d", len(k1), len(k2), StemSize+1)
+	}
+	for i := 0; i < StemSize; i++ {
+		if k1[i] != k2[i] {
+			return nil, fmt.Errorf("keys %x and %x diverge at depth %d", k1, k2, i+1)
+		}
+	}
+	leaf, err := n.getLeafAtStem(k1[:StemSize], resolver)
+	if err != nil {
+		return nil, err
+	}
+	if leaf == nil {
+		return nil, fmt.Errorf("stem %x is not present in the tree", k1[:StemSize])
+	}
+
+	var keys [][]byte
+	switch bytes.Compare(k1, k2) {
+	case -1:
+		keys = [][]byte{k1, k2}
+	case 0:
+		keys = [][]byte{k1}
+	case 1:
+		keys = [][]byte{k2, k1}
+	}
+	n.Commit()
+	proof, _, _, _, err := MakeVerkleMultiProof(n, nil, keys, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// ProveAccountSlot returns the openings needed to prove, in a single
+// multiproof, that the account whose header stem is stem exists and what
+// the value at suffix is: the openings of the internal nodes on the path
+// to the header leaf, its extension openings, and the suffix openings of
+// both the version field, which is set in every account header, and the
+// requested slot. An error is returned if there is no account at stem.
+func (n *InternalNode) ProveAccountSlot(stem []byte, suffix byte, resolver NodeResolverFn) (*ProofElements, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	leaf, err := n.getLeafAtStem(stem, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if leaf == nil || !isAccountHeader(leaf.values) {
+		return nil, fmt.Errorf("no account at stem %x", stem)
+	}
+
+	keys := keylist{append(append(make([]byte, 0, StemSize+1), stem...), VersionLeafKey)}
+	if suffix != VersionLeafKey {
+		keys = append(keys, append(append(make([]byte, 0, StemSize+1), stem...), suffix))
+	}
+	n.Commit()
+	pe, _, _, err := GetCommitmentsForMultiproof(n, keys, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return pe, nil
+}
+
+// VerifyStemAbsence checks that proof, as built by ProveStemAbsent,
+// proves that stem is absent from the tree whose root commitment is root.
+func VerifyStemAbsence(proof *Proof, stem []byte, root *Point) error {
+	if len(proof.Keys) != 1 || !equalPaths(proof.Keys[0], stem) {
+		return fmt.Errorf("proof is not about stem %x", stem)
+	}
+	if len(proof.ExtStatus) != 1 || proof.ExtStatus[0]&3 == extStatusPresent {
+		return fmt.Errorf("proof does not show the absence of stem %x", stem)
+	}
+	pretree, err := PreStateTreeFromProof(proof, root)
+	if err != nil {
+		return fmt.Errorf("rebuilding the pre-state tree: %w", err)
+	}
+	return VerifyVerkleProofWithPreState(proof, pretree)
+}
+
+// AbsenceKind tells what a proof has to show about the stem of a key,
+// mirroring the extension status that the proof will hold for it.
+type AbsenceKind byte
+
+const (
+	// AbsenceKindEmpty means that the path of the stem ends in an
+	// empty node, whose commitment has to be opened to zero.
+	AbsenceKindEmpty = AbsenceKind(extStatusAbsentEmpty)
+	// AbsenceKindOtherLeaf means that the path of the stem ends in a
+	// leaf with another stem, whose stem and commitment have to be
+	// included.
+	AbsenceKindOtherLeaf = AbsenceKind(extStatusAbsentOther)
+	// AbsenceKindPresent means that the leaf of the stem is in the
+	// tree. The value itself can still be missing, which is proven by
+	// opening the leaf at its suffix.
+	AbsenceKindPresent = AbsenceKind(extStatusPresent)
+)
+
+// AbsenceObligations classifies each key according to what a proof has
+// to show about its stem. The result is indexed by string(key).
+func (n *InternalNode) AbsenceObligations(keys [][]byte, resolver NodeResolverFn) (map[string]AbsenceKind, error) {
+	kinds := make(map[string]AbsenceKind, len(keys))
+	for _, key := range keys {
+		if len(key) != StemSize+1 {
+			return nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+		}
+		leaf, err := n.getLeafOnPath(key[:StemSize], resolver)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case leaf == nil:
+			kinds[string(key)] = AbsenceKindEmpty
+		case !equalPaths(leaf.stem, key):
+			kinds[string(key)] = AbsenceKindOtherLeaf
+		default:
+			kinds[string(key)] = AbsenceKindPresent
+		}
+	}
+	return kinds, nil
+}
+
+// VerifiableGet bundles the value read at a key with a proof of that
+// value against the root commitment of the tree it was read from.
+type VerifiableGet struct {
+	Key   []byte
+	Value []byte // nil if the key is absent
+	Root  *Point
+	Proof *Proof
+}
+
+// GetVerifiable reads the value at key and proves it, returning both in
+// a bundle that can be checked with VerifiableGet.Verify. The tree is
+// committed first.
+func (n *InternalNode) GetVerifiable(key []byte, resolver NodeResolverFn) (*VerifiableGet, error) {
+	value, err := n.Get(key, resolver)
+	if err != nil {
+		return nil, err
+	}
+	root := n.Commit()
+	proof, _, _, _, err := MakeVerkleMultiProof(n, nil, [][]byte{key}, resolver)
+	if err != nil {
+		return nil, err
+	}
+	vg := &VerifiableGet{
+		Key:   append([]byte(nil), key...),
+		Root:  new(Point).Set(root),
+		Proof: proof,
+	}
+	if value != nil {
+		vg.Value = append([]byte{}, value...)
+	}
+	return vg, nil
+}
+
+// Verify checks that the bundle was built from a tree whose root
+// commitment is expectedRoot, and that its proof shows that Value is
+// stored at Key in that tree. It returns false without an error if the
+// bundle is well-formed but doesn't match expectedRoot or its own value.
+func (vg *VerifiableGet) Verify(expectedRoot *Point) (bool, error) {
+	if !vg.Root.Equal(expectedRoot) {
+		return false, nil
+	}
+	if len(vg.Proof.Keys) != 1 || !bytes.Equal(vg.Proof.Keys[0], vg.Key) {
+		return false, fmt.Errorf("proof is not about key %x", vg.Key)
+	}
+	pretree, err := VerifiedPreStateTreeFromProof(vg.Proof, vg.Root)
+	if err != nil {
+		return false, err
+	}
+	value, err := pretree.Get(vg.Key, nil)
+	if err != nil {
+		return false, fmt.Errorf("reading the proven value: %w", err)
+	}
+	return (value == nil) == (vg.Value == nil) && bytes.Equal(value, vg.Value), nil
+}
+
 // VerifyVerkleProofWithPreState takes a proof and a trusted tree root and verifies that the proof is valid.
 func VerifyVerkleProofWithPreState(proof *Proof, preroot VerkleNode) error {
 	pe, _, _, _, err := getProofElementsFromTree(preroot, nil, proof.Keys, nil)
@@ -514,6 +847,22 @@ func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { //
 	return root, nil
 }
 
+// VerifiedPreStateTreeFromProof builds the prestate tree from the proof
+// like PreStateTreeFromProof does, and then checks the proof against it,
+// so that an error is returned if the commitments and values carried by
+// the proof don't open to rootC. Reads on the returned tree can be
+// trusted to be consistent with rootC.
+func VerifiedPreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) {
+	pretree, err := PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		return nil, fmt.Errorf("error rebuilding the pre-state tree: %w", err)
+	}
+	if err := VerifyVerkleProofWithPreState(proof, pretree); err != nil {
+		return nil, err
+	}
+	return pretree, nil
+}
+
 // PostStateTreeFromProof uses the pre-state trie and the list of updated values
 // to produce the stateless post-state trie.
 func PostStateTreeFromStateDiff(preroot VerkleNode, statediff StateDiff) (VerkleNode, error) {
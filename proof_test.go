@@ -29,10 +29,13 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
+	ipa "github.com/crate-crypto/go-ipa"
 	"github.com/crate-crypto/go-ipa/common"
 )
 
@@ -1261,3 +1264,626 @@ func TestProveAbsenceInEmptyHalf(t *testing.T) {
 		t.Fatalf("invalid number of extension status: %d", len(proof.ExtStatus))
 	}
 }
+
+func TestProofSize(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// Keys in the same stem as a present key, in both halves.
+	sameStem := func(key []byte, suffix byte) []byte {
+		k := append([]byte{}, key...)
+		k[StemSize] = suffix
+		return k
+	}
+	absent := randomKeys(t, 10)
+	for _, tc := range [][][]byte{
+		keys[:1],
+		keys[:10],
+		keys,
+		absent,
+		append(append([][]byte{}, keys[:5]...), absent...),
+		{keys[0], sameStem(keys[0], 3), sameStem(keys[0], 200), sameStem(keys[0], 255)},
+		{keys[3], keys[3], keys[3]},
+		{zeroKeyTest, ffx32KeyTest},
+	} {
+		size, err := root.ProofSize(tc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := make([][]byte, len(tc))
+		copy(query, tc)
+		pe, _, _, err := GetCommitmentsForMultiproof(root, query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(pe.Cis) {
+			t.Fatalf("invalid proof size for %d keys: %d != %d", len(tc), size, len(pe.Cis))
+		}
+	}
+
+	if _, err := root.ProofSize(nil, nil); err == nil {
+		t.Fatal("expected an error when no key is provided")
+	}
+}
+
+func TestGetBatchWithProof(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 50)
+	root := New().(*InternalNode)
+	for i, key := range keys {
+		if err := root.Insert(key, bytes.Repeat([]byte{byte(i)}, LeafValueSize), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unsorted keys, with an absent key and a duplicate.
+	query := [][]byte{keys[7], keys[3], ffx32KeyTest, keys[42], keys[3]}
+	original := make([][]byte, len(query))
+	copy(original, query)
+	values, pe, err := root.GetBatchWithProof(query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range query {
+		if !bytes.Equal(query[i], original[i]) {
+			t.Fatal("keys were modified")
+		}
+		expected, err := root.Get(query[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(values[i], expected) {
+			t.Fatalf("invalid value for key %x: %x != %x", query[i], values[i], expected)
+		}
+	}
+
+	// The proof elements must be the same as those built separately.
+	sorted := make([][]byte, len(query))
+	copy(sorted, query)
+	expected, _, _, err := GetCommitmentsForMultiproof(root, sorted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pe.Cis) != len(expected.Cis) {
+		t.Fatalf("invalid number of openings: %d != %d", len(pe.Cis), len(expected.Cis))
+	}
+	for i := range pe.Cis {
+		if !pe.Cis[i].Equal(expected.Cis[i]) || pe.Zis[i] != expected.Zis[i] || !pe.Yis[i].Equal(expected.Yis[i]) {
+			t.Fatalf("invalid opening %d", i)
+		}
+	}
+
+	if _, _, err := root.GetBatchWithProof(nil, nil); err == nil {
+		t.Fatal("expected an error when no key is provided")
+	}
+}
+
+func TestProveStemAbsent(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+
+	for _, tc := range []struct {
+		name   string
+		stem   []byte
+		status byte
+	}{
+		{"empty path", ffx32KeyTest[:StemSize], extStatusAbsentEmpty},
+		{"other stem", forkOneKeyTest[:StemSize], extStatusAbsentOther},
+	} {
+		proof, err := root.ProveStemAbsent(tc.stem, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if proof.ExtStatus[0]&3 != tc.status {
+			t.Fatalf("%s: invalid extension status %d", tc.name, proof.ExtStatus[0]&3)
+		}
+
+		// Verify the proof after a serialization round-trip.
+		vp, sd, err := SerializeProof(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dproof, err := DeserializeProof(vp, sd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyStemAbsence(dproof, tc.stem, rootC); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := VerifyStemAbsence(dproof, oneKeyTest[:StemSize], rootC); err == nil {
+			t.Fatalf("%s: proof should not apply to another stem", tc.name)
+		}
+		if err := VerifyStemAbsence(dproof, tc.stem, New().Commitment()); err == nil {
+			t.Fatalf("%s: proof should not verify against another root", tc.name)
+		}
+	}
+
+	if _, err := root.ProveStemAbsent(zeroKeyTest[:StemSize], nil); err == nil {
+		t.Fatal("expected an error for a present stem")
+	}
+
+	// A proof of presence can't be passed off as a proof of absence.
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{zeroKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyStemAbsence(proof, zeroKeyTest[:StemSize], rootC); err == nil {
+		t.Fatal("a proof of presence should not verify as a proof of absence")
+	}
+}
+
+func TestProofOfAbsenceAfterDelete(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatalf("could not insert key: %v", err)
+	}
+	if err := root.Insert(oneKeyTest, testValue, nil); err != nil {
+		t.Fatalf("could not insert key: %v", err)
+	}
+	root.Commit()
+	if _, err := root.Delete(oneKeyTest, nil); err != nil {
+		t.Fatalf("could not delete key: %v", err)
+	}
+	rootC := root.Commit()
+
+	// The deleted value must not leave a leaf marker behind.
+	expected := New()
+	if err := expected.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatalf("could not insert key: %v", err)
+	}
+	if !expected.Commit().Equal(rootC) {
+		t.Fatal("deleting a value should produce the same root as never inserting it")
+	}
+
+	proof, cis, zis, yis, err := MakeVerkleMultiProof(root, nil, [][]byte{oneKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyVerkleProof(proof, cis, zis, yis, GetConfig()); !ok || err != nil {
+		t.Fatalf("could not verify verkle proof: %v", err)
+	}
+	// The stem is still present, so this is a missing value and not
+	// a missing suffix tree.
+	if len(proof.ExtStatus) != 1 || proof.ExtStatus[0]&3 != extStatusPresent {
+		t.Fatalf("invalid extension status %v", proof.ExtStatus)
+	}
+	if len(proof.PreValues) != 1 || proof.PreValues[0] != nil {
+		t.Fatalf("expected a nil pre-value, got %x", proof.PreValues)
+	}
+	if err := VerifyVerkleProofWithPreState(proof, root); err != nil {
+		t.Fatalf("could not verify proof against the pre-state: %v", err)
+	}
+
+	deserialized, err := PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatalf("error deserializing %v", err)
+	}
+	got, err := deserialized.Get(oneKeyTest, nil)
+	if err != nil || got != nil {
+		t.Fatalf("expected a missing value, got %x, %v", got, err)
+	}
+}
+
+func TestAbsenceObligations(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	expected := map[string]AbsenceKind{
+		string(zeroKeyTest):    AbsenceKindPresent,
+		string(oneKeyTest):     AbsenceKindPresent, // missing value in a present stem
+		string(forkOneKeyTest): AbsenceKindOtherLeaf,
+		string(fourtyKeyTest):  AbsenceKindEmpty,
+	}
+	var keys [][]byte
+	for key := range expected {
+		keys = append(keys, []byte(key))
+	}
+	kinds, err := root.AbsenceObligations(keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kinds) != len(expected) {
+		t.Fatalf("invalid number of classified keys: %d != %d", len(kinds), len(expected))
+	}
+	for key, kind := range expected {
+		if kinds[key] != kind {
+			t.Fatalf("key %x: expected %d, got %d", key, kind, kinds[key])
+		}
+	}
+
+	// The classification agrees with the extension statuses of a
+	// proof for each key.
+	for _, key := range keys {
+		proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{key}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if AbsenceKind(proof.ExtStatus[0]&3) != kinds[string(key)] {
+			t.Fatalf("key %x: proof has extension status %d, expected %d", key, proof.ExtStatus[0]&3, kinds[string(key)])
+		}
+	}
+
+	if _, err := root.AbsenceObligations([][]byte{zeroKeyTest[:StemSize]}, nil); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+}
+
+func TestProofElementsBytes(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+	pe, _, _, err := root.GetProofItems(keylist{zeroKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yis, zis := pe.YisBytes(), pe.ZisBytes()
+	if len(yis) != len(pe.Yis) || !bytes.Equal(zis, pe.Zis) {
+		t.Fatalf("invalid lengths: %d yis, %d zis", len(yis), len(zis))
+	}
+
+	// Suffix 0 is stored in C1 as two evaluations: the low 16 bytes of
+	// the value with the leaf marker set at bit 128, then the high 16
+	// bytes, both in little-endian form.
+	var low, high [32]byte
+	copy(low[:], testValue[:16])
+	low[16] = 1
+	copy(high[:], testValue[16:])
+	c1 := root.children[0].(*LeafNode).c1
+	var found int
+	for i := range pe.Cis {
+		if pe.Cis[i] != c1 {
+			continue
+		}
+		switch zis[i] {
+		case 0:
+			if yis[i] != low {
+				t.Fatalf("invalid encoding of the low half: %x != %x", yis[i], low)
+			}
+			found++
+		case 1:
+			if yis[i] != high {
+				t.Fatalf("invalid encoding of the high half: %x != %x", yis[i], high)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected 2 openings of C1, got %d", found)
+	}
+}
+
+func TestLeafProveSuffixes(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	values[200] = fourtyKeyTest
+	leaf, err := NewLeafNode(ffx32KeyTest[:StemSize], values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of order, with a duplicate and a missing value in each half.
+	pe, err := leaf.ProveSuffixes([]byte{200, 0, 5, 200, 130})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{testValue, nil, nil, fourtyKeyTest}
+	if len(pe.Vals) != len(expected) {
+		t.Fatalf("invalid number of values: %d != %d", len(pe.Vals), len(expected))
+	}
+	for i := range expected {
+		if !bytes.Equal(pe.Vals[i], expected[i]) {
+			t.Fatalf("invalid value %d: %x != %x", i, pe.Vals[i], expected[i])
+		}
+	}
+
+	// The openings can be turned into a multiproof that verifies.
+	cfg := GetConfig()
+	mp, err := ipa.CreateMultiProof(common.NewTranscript("vt"), cfg.conf, pe.Cis, pe.Fis, pe.Zis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ipa.CheckMultiProof(common.NewTranscript("vt"), cfg.conf, mp, pe.Cis, pe.Yis, pe.Zis); !ok || err != nil {
+		t.Fatalf("could not verify the openings: %v", err)
+	}
+
+	if _, err := leaf.ProveSuffixes(nil); err == nil {
+		t.Fatal("expected an error when no suffix is given")
+	}
+
+	stub := &LeafNode{stem: leaf.stem, isPOAStub: true}
+	if _, err := stub.ProveSuffixes([]byte{0}); !errors.Is(err, errIsPOAStub) {
+		t.Fatalf("expected %v, got %v", errIsPOAStub, err)
+	}
+}
+
+func TestProveSameLeaf(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// oneKeyTest is missing, but shares the leaf of zeroKeyTest.
+	for _, keys := range [][2][]byte{{zeroKeyTest, oneKeyTest}, {oneKeyTest, zeroKeyTest}, {zeroKeyTest, zeroKeyTest}} {
+		proof, err := root.ProveSameLeaf(keys[0], keys[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, es := range proof.ExtStatus {
+			if es&3 != extStatusPresent {
+				t.Fatalf("invalid extension status %d", es)
+			}
+		}
+		if err := VerifyVerkleProofWithPreState(proof, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := root.ProveSameLeaf(zeroKeyTest, forkOneKeyTest, nil); err == nil || !strings.Contains(err.Error(), "diverge at depth 2") {
+		t.Fatalf("expected a divergence at depth 2, got %v", err)
+	}
+	absent := append(append([]byte{}, fourtyKeyTest[:StemSize]...), 1)
+	if _, err := root.ProveSameLeaf(fourtyKeyTest, absent, nil); err == nil {
+		t.Fatal("expected an error for an absent stem")
+	}
+	if _, err := root.ProveSameLeaf(zeroKeyTest, zeroKeyTest[:StemSize], nil); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+}
+
+func TestProofOfAbsenceInEmptyTree(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	rootC := root.Commit()
+	if !rootC.Equal(new(Point).SetIdentity()) {
+		t.Fatal("the empty tree should commit to the identity")
+	}
+
+	keys := keylist{zeroKeyTest, ffx32KeyTest}
+	proof, cis, zis, yis, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range yis {
+		if !yis[i].IsZero() {
+			t.Fatalf("opening %d of the empty tree should be zero", i)
+		}
+	}
+	for _, es := range proof.ExtStatus {
+		if es&3 != extStatusAbsentEmpty || es>>3 != 1 {
+			t.Fatalf("invalid extension status %x", es)
+		}
+	}
+	if ok, err := VerifyVerkleProof(proof, cis, zis, yis, cfg); !ok || err != nil {
+		t.Fatalf("could not verify the proof: %v", err)
+	}
+
+	// Round-trip through the wire format and verify against a rebuilt
+	// pre-state tree.
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dproof, err := DeserializeProof(vp, statediff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droot, err := PreStateTreeFromProof(dproof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyVerkleProofWithPreState(dproof, droot); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if value, err := droot.Get(key, nil); err != nil || value != nil {
+			t.Fatalf("expected an absent value for %x, got %x, %v", key, value, err)
+		}
+	}
+}
+
+func TestGetVerifiable(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+
+	for _, tc := range []struct {
+		key   []byte
+		value []byte
+	}{
+		{zeroKeyTest, testValue},
+		{oneKeyTest, nil},    // missing value in a present leaf
+		{fourtyKeyTest, nil}, // missing stem
+	} {
+		vg, err := root.GetVerifiable(tc.key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(vg.Value, tc.value) || (vg.Value == nil) != (tc.value == nil) {
+			t.Fatalf("key %x: invalid value %x", tc.key, vg.Value)
+		}
+		if ok, err := vg.Verify(rootC); !ok || err != nil {
+			t.Fatalf("key %x: could not verify: %v", tc.key, err)
+		}
+		if ok, _ := vg.Verify(new(Point).SetIdentity()); ok {
+			t.Fatalf("key %x: verified against the wrong root", tc.key)
+		}
+
+		// Claim another value than the proven one.
+		vg.Value = fourtyKeyTest
+		if ok, _ := vg.Verify(rootC); ok {
+			t.Fatalf("key %x: verified a forged value", tc.key)
+		}
+	}
+}
+
+func TestVerifiedPreStateTreeFromProof(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, k := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(k, fourtyKeyTest, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	rootC := root.Commit()
+	keys := keylist{zeroKeyTest, fourtyKeyTest}
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatalf("could not make proof: %v", err)
+	}
+
+	pretree, err := VerifiedPreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := pretree.Get(zeroKeyTest, nil)
+	if err != nil || !bytes.Equal(value, fourtyKeyTest) {
+		t.Fatalf("invalid value in the pre-state tree: %x, %v", value, err)
+	}
+
+	if _, err := VerifiedPreStateTreeFromProof(proof, new(Point).SetIdentity()); err == nil {
+		t.Fatal("a proof verified against the wrong root")
+	}
+
+	// A witness that serves a plausible-looking value that isn't in the
+	// tree is rebuilt without an error, but can't be verified.
+	proof.PreValues[0] = testValue
+	if _, err := PreStateTreeFromProof(proof, rootC); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifiedPreStateTreeFromProof(proof, rootC); err == nil {
+		t.Fatal("a tampered witness verified")
+	}
+}
+
+func TestProveAccountSlot(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	values, err := NewEmptyAccount().ToValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values[HeaderStorageOffset] = testValue
+	root := New().(*InternalNode)
+	if err := root.InsertValuesAtStem(stem, values, nil); err != nil {
+		t.Fatal(err)
+	}
+	// A storage stem that isn't an account header.
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := GetConfig()
+	for _, tc := range []struct {
+		suffix   byte
+		expected [][]byte
+	}{
+		{HeaderStorageOffset, [][]byte{values[VersionLeafKey], testValue}},
+		{HeaderStorageOffset + 1, [][]byte{values[VersionLeafKey], nil}}, // missing slot
+		{NonceLeafKey, [][]byte{values[VersionLeafKey], values[NonceLeafKey]}},
+		{VersionLeafKey, [][]byte{values[VersionLeafKey]}},
+	} {
+		pe, err := root.ProveAccountSlot(stem, tc.suffix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pe.Vals) != len(tc.expected) {
+			t.Fatalf("suffix %d: invalid number of values %d != %d", tc.suffix, len(pe.Vals), len(tc.expected))
+		}
+		for i := range tc.expected {
+			if !bytes.Equal(pe.Vals[i], tc.expected[i]) {
+				t.Fatalf("suffix %d: invalid value %d: %x != %x", tc.suffix, i, pe.Vals[i], tc.expected[i])
+			}
+		}
+		if !pe.Cis[0].Equal(root.Commitment()) {
+			t.Fatalf("suffix %d: the openings don't start at the root", tc.suffix)
+		}
+		mp, err := ipa.CreateMultiProof(common.NewTranscript("vt"), cfg.conf, pe.Cis, pe.Fis, pe.Zis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := ipa.CheckMultiProof(common.NewTranscript("vt"), cfg.conf, mp, pe.Cis, pe.Yis, pe.Zis); !ok || err != nil {
+			t.Fatalf("suffix %d: could not verify the openings: %v", tc.suffix, err)
+		}
+	}
+
+	for _, stem := range [][]byte{zeroKeyTest[:StemSize], fourtyKeyTest[:StemSize]} {
+		if _, err := root.ProveAccountSlot(stem, HeaderStorageOffset, nil); err == nil {
+			t.Fatalf("expected an error for stem %x, which holds no account", stem)
+		}
+	}
+}
+
+func TestPreStateTreeFromProofTruncatedCommitments(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, k := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(k, fourtyKeyTest, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	rootC := root.Commit()
+	// The keys go through an internal node, a present leaf with
+	// both suffix trees and a proof of absence stem.
+	key := append([]byte{}, forkOneKeyTest...)
+	key[StemSize] = 200
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{zeroKeyTest, key, oneKeyTest, fourtyKeyTest}, nil)
+	if err != nil {
+		t.Fatalf("could not make proof: %v", err)
+	}
+	if _, err := PreStateTreeFromProof(proof, rootC); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := proof.Cs
+	for i := range cs {
+		proof.Cs = cs[:i]
+		if _, err := PreStateTreeFromProof(proof, rootC); err == nil {
+			t.Fatalf("expected an error for a proof truncated to %d of %d commitments", i, len(cs))
+		}
+	}
+}
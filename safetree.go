@@ -0,0 +1,139 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import "sync"
+
+// SafeTree wraps the root of a tree so that it can be used from several
+// goroutines. Operations that only read the tree take a read lock, and
+// those that modify it, including the computation of commitments, take
+// the write lock.
+//
+// Reads are only side-effect free when no resolver is provided: a
+// resolver replaces the hashed nodes that it resolves with their full
+// version, so a Get with a non-nil resolver takes the write lock. The
+// same goes for GetProofItems, which resolves all the siblings along
+// the paths it visits. Commitment and Hash return the commitment as of
+// the last call to Commit. Commit and Commitment return a copy of the
+// root commitment, as the tree updates its own in place.
+type SafeTree struct {
+	mu   sync.RWMutex
+	root *InternalNode
+}
+
+// NewSafeTree returns a SafeTree wrapping root. root must not be used
+// directly after this call.
+func NewSafeTree(root *InternalNode) *SafeTree {
+	return &SafeTree{root: root}
+}
+
+func (t *SafeTree) Insert(key []byte, value []byte, resolver NodeResolverFn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.Insert(key, value, resolver)
+}
+
+func (t *SafeTree) Delete(key []byte, resolver NodeResolverFn) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.Delete(key, resolver)
+}
+
+func (t *SafeTree) Get(key []byte, resolver NodeResolverFn) ([]byte, error) {
+	if resolver != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	} else {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+	}
+	return t.root.Get(key, resolver)
+}
+
+func (t *SafeTree) Commit() *Point {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return new(Point).Set(t.root.Commit())
+}
+
+func (t *SafeTree) Commitment() *Point {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return new(Point).Set(t.root.Commitment())
+}
+
+func (t *SafeTree) Hash() *Fr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.Hash()
+}
+
+func (t *SafeTree) GetProofItems(keys keylist, resolver NodeResolverFn) (*ProofElements, []byte, [][]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.GetProofItems(keys, resolver)
+}
+
+func (t *SafeTree) Serialize() ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.Serialize()
+}
+
+// Copy returns a SafeTree wrapping a copy of the tree.
+func (t *SafeTree) Copy() VerkleNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return NewSafeTree(t.root.Copy().(*InternalNode))
+}
+
+// Flush commits the tree and calls flush for each of its nodes, see
+// InternalNode.Flush.
+func (t *SafeTree) Flush(flush NodeFlushFn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.root.Flush(flush)
+}
+
+// TryFlush is like Flush, but returns ErrFrozen if the tree is frozen,
+// see InternalNode.TryFlush.
+func (t *SafeTree) TryFlush(flush NodeFlushFn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.TryFlush(flush)
+}
+
+func (t *SafeTree) toDot(parent, path string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.toDot(parent, path)
+}
+
+func (t *SafeTree) setDepth(depth byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.root.setDepth(depth)
+}
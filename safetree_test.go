@@ -0,0 +1,84 @@
+package verkle
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+var _ VerkleNode = (*SafeTree)(nil)
+
+// TestSafeTreeConcurrentAccess is meant to be run with the race detector.
+func TestSafeTreeConcurrentAccess(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 200)
+	tree := NewSafeTree(New().(*InternalNode))
+	for _, key := range keys[:100] {
+		if err := tree.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Commit()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		for _, key := range keys[100:] {
+			if err := tree.Insert(key, fourtyKeyTest, nil); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			tree.Commit()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// The returned commitments are read while other goroutines
+		// insert and commit.
+		for i := 0; i < 10; i++ {
+			c := tree.Commitment()
+			for j := 0; j < 10; j++ {
+				_ = c.Bytes()
+			}
+		}
+	}()
+	for g := 0; g < 2; g++ {
+		go func() {
+			defer wg.Done()
+			for _, key := range keys[:100] {
+				value, err := tree.Get(key, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(value, fourtyKeyTest) {
+					t.Errorf("invalid value for key %x", key)
+				}
+				tree.Hash()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	expected := New()
+	for _, key := range keys {
+		if err := expected.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !tree.Commit().Equal(expected.Commit()) {
+		t.Fatal("invalid root commitment after concurrent inserts")
+	}
+}
@@ -0,0 +1,138 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// A snapshot holds all the nodes of a tree, along with a header and a
+// checksum so that corrupted or truncated snapshots are detected when
+// they are loaded. The layout is:
+//
+//	<magic[4]><version[1]><width[1]><node...><sha256[32]>
+//
+// where width is the base-2 logarithm of NodeWidth, each node is
+// encoded as <path length[1]><path><length[4]><serialized node>, and
+// the checksum covers everything that precedes it.
+const (
+	snapshotVersion      = 1
+	snapshotHeaderSize   = len(snapshotMagic) + 2
+	snapshotChecksumSize = sha256.Size
+)
+
+var (
+	snapshotMagic = [4]byte{'v', 'k', 't', 's'}
+
+	errSnapshotChecksum = errors.New("invalid snapshot checksum")
+	errSnapshotHeader   = errors.New("invalid snapshot header")
+)
+
+// WriteTreeTo commits the tree and writes a snapshot of it to w. The
+// whole tree must be in memory.
+func WriteTreeTo(w io.Writer, root *InternalNode) error {
+	if err := root.checkFullyResolved(); err != nil {
+		return fmt.Errorf("tree is not fully in memory: %w", err)
+	}
+	root.Commit()
+	nodes, err := root.BatchSerialize()
+	if err != nil {
+		return fmt.Errorf("serializing tree: %w", err)
+	}
+
+	hasher := sha256.New()
+	mw := io.MultiWriter(w, hasher)
+	header := append(snapshotMagic[:], snapshotVersion, byte(bits.TrailingZeros(NodeWidth)))
+	if _, err := mw.Write(header); err != nil {
+		return err
+	}
+	var length [4]byte
+	for _, node := range nodes {
+		binary.BigEndian.PutUint32(length[:], uint32(len(node.SerializedBytes)))
+		if _, err := mw.Write([]byte{byte(len(node.Path))}); err != nil {
+			return err
+		}
+		if _, err := mw.Write(node.Path); err != nil {
+			return err
+		}
+		if _, err := mw.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := mw.Write(node.SerializedBytes); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(hasher.Sum(nil))
+	return err
+}
+
+// ReadTreeFrom reads a snapshot written by WriteTreeTo, and rebuilds
+// the tree. The checksum is verified before any node is parsed.
+func ReadTreeFrom(r io.Reader) (*InternalNode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < snapshotHeaderSize+snapshotChecksumSize {
+		return nil, fmt.Errorf("snapshot is too short: %d bytes: %w", len(data), errSnapshotChecksum)
+	}
+	payload, checksum := data[:len(data)-snapshotChecksumSize], data[len(data)-snapshotChecksumSize:]
+	if sum := sha256.Sum256(payload); !bytes.Equal(sum[:], checksum) {
+		return nil, errSnapshotChecksum
+	}
+	if !bytes.Equal(payload[:len(snapshotMagic)], snapshotMagic[:]) {
+		return nil, fmt.Errorf("unknown magic %x: %w", payload[:len(snapshotMagic)], errSnapshotHeader)
+	}
+	if version := payload[len(snapshotMagic)]; version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d: %w", version, errSnapshotHeader)
+	}
+	if width := payload[len(snapshotMagic)+1]; int(width) != bits.TrailingZeros(NodeWidth) {
+		return nil, fmt.Errorf("unsupported node width 2^%d: %w", width, errSnapshotHeader)
+	}
+
+	var nodes []SerializedNode
+	for payload = payload[snapshotHeaderSize:]; len(payload) > 0; {
+		pathLen := int(payload[0])
+		if len(payload) < 1+pathLen+4 {
+			return nil, fmt.Errorf("truncated node entry: %w", errSerializedPayloadTooShort)
+		}
+		path := payload[1 : 1+pathLen]
+		nodeLen := int(binary.BigEndian.Uint32(payload[1+pathLen:]))
+		payload = payload[1+pathLen+4:]
+		if len(payload) < nodeLen {
+			return nil, fmt.Errorf("truncated node at path %x: %w", path, errSerializedPayloadTooShort)
+		}
+		nodes = append(nodes, SerializedNode{Path: path, SerializedBytes: payload[:nodeLen]})
+		payload = payload[nodeLen:]
+	}
+	return RebuildFromFlush(nodes)
+}
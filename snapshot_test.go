@@ -0,0 +1,71 @@
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := WriteTreeTo(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), append(snapshotMagic[:], snapshotVersion, 8)) {
+		t.Fatalf("invalid snapshot header %x", buf.Bytes()[:snapshotHeaderSize])
+	}
+	snapshot := buf.Bytes()
+
+	loaded, err := ReadTreeFrom(bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isInternalEqual(root, loaded) || !loaded.Commit().Equal(root.Commitment()) {
+		t.Fatal("loaded tree is different from the original")
+	}
+
+	// Flipping a byte in the middle must be detected.
+	corrupted := append([]byte{}, snapshot...)
+	corrupted[len(corrupted)/2] ^= 1
+	if _, err := ReadTreeFrom(bytes.NewReader(corrupted)); err != errSnapshotChecksum {
+		t.Fatalf("expected %v, got %v", errSnapshotChecksum, err)
+	}
+	// So must a truncation.
+	if _, err := ReadTreeFrom(bytes.NewReader(snapshot[:len(snapshot)-1])); err != errSnapshotChecksum {
+		t.Fatalf("expected %v, got %v", errSnapshotChecksum, err)
+	}
+	if _, err := ReadTreeFrom(bytes.NewReader(snapshot[:10])); !errors.Is(err, errSnapshotChecksum) {
+		t.Fatalf("expected %v, got %v", errSnapshotChecksum, err)
+	}
+
+	// Trees that are partly flushed can't be snapshotted.
+	root.Flush(func([]byte, VerkleNode) {})
+	if err := WriteTreeTo(&buf, root); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+}
+
+func TestSnapshotEmptyTree(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := WriteTreeTo(&buf, New().(*InternalNode)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadTreeFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Commitment().Equal(New().Commitment()) {
+		t.Fatal("invalid commitment for an empty tree")
+	}
+}
@@ -0,0 +1,96 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// StructuralHash returns a sha256 digest of the keys and values held by
+// the tree. It is NOT a verkle commitment and can't be used in proofs:
+// it is only meant to be a cheap way to compare trees or to detect that
+// a tree has changed, as it involves no elliptic-curve operation.
+//
+// The hash covers the shape of the tree as well as its content: trees
+// holding the same key/value pairs only have the same structural hash if
+// their leaves sit at the same depths. This is always the case for trees
+// built by insertions only, but since Delete doesn't collapse internal
+// nodes, a tree from which keys were deleted can hash differently from
+// one into which the remaining keys were inserted directly. The tree must be fully in memory: hashed and unknown nodes cause an
+// error to be returned.
+func (n *InternalNode) StructuralHash() ([32]byte, error) {
+	h := sha256.New()
+	h.Write([]byte{internalRLPType})
+	for i, child := range n.children {
+		var (
+			childHash [32]byte
+			err       error
+		)
+		switch child := child.(type) {
+		case Empty:
+			continue
+		case *InternalNode:
+			childHash, err = child.StructuralHash()
+		case *LeafNode:
+			childHash = child.structuralHash()
+		case HashedNode:
+			err = fmt.Errorf("hashed node at depth %d, index %d can not be hashed: %w", n.depth+1, i, errReadFromInvalid)
+		case UnknownNode:
+			err = fmt.Errorf("StructuralHash at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+		default:
+			err = errUnknownNodeType
+		}
+		if err != nil {
+			return [32]byte{}, err
+		}
+		h.Write([]byte{byte(i)})
+		h.Write(childHash[:])
+	}
+
+	var ret [32]byte
+	h.Sum(ret[:0])
+	return ret, nil
+}
+
+// structuralHash folds the stem and the present values of the leaf,
+// along with their suffix and length so that the encoding is unambiguous.
+func (n *LeafNode) structuralHash() [32]byte {
+	h := sha256.New()
+	h.Write([]byte{leafRLPType})
+	h.Write(n.stem)
+	for i, value := range n.values {
+		if value == nil {
+			continue
+		}
+		h.Write([]byte{byte(i), byte(len(value))})
+		h.Write(value)
+	}
+
+	var ret [32]byte
+	h.Sum(ret[:0])
+	return ret
+}
@@ -0,0 +1,87 @@
+package verkle
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStructuralHash(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	build := func(keys [][]byte) *InternalNode {
+		root := New().(*InternalNode)
+		for _, key := range keys {
+			if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+	root := build(keys)
+	hash, err := root.StructuralHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The insertion order doesn't matter.
+	reversed := make([][]byte, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	other, err := build(reversed).StructuralHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other != hash {
+		t.Fatal("trees with the same content should have the same structural hash")
+	}
+
+	// Any change to a value is detected.
+	if err := root.Insert(keys[42], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if other, err = root.StructuralHash(); err != nil || other == hash {
+		t.Fatalf("a modified value should change the structural hash, err=%v", err)
+	}
+	if err := root.Insert(keys[42], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if other, err = root.StructuralHash(); err != nil || other != hash {
+		t.Fatalf("restoring the value should restore the structural hash, err=%v", err)
+	}
+
+	// The empty tree and a tree with a single empty value differ.
+	empty, _ := New().(*InternalNode).StructuralHash()
+	single := New().(*InternalNode)
+	if err := single.Insert(zeroKeyTest, []byte{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ = single.StructuralHash(); other == empty {
+		t.Fatal("an empty value should be hashed")
+	}
+
+	// Deletions don't collapse internal nodes, so the structural hash
+	// depends on the history of the tree and not only on its content.
+	deleted := build([][]byte{zeroKeyTest, forkOneKeyTest})
+	if _, err := deleted.Delete(forkOneKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	deletedHash, err := deleted.StructuralHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertedHash, err := build([][]byte{zeroKeyTest}).StructuralHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deletedHash == insertedHash {
+		t.Fatal("trees with different shapes should have different structural hashes")
+	}
+
+	root.Commit()
+	root.children[keys[0][0]] = HashedNode{}
+	if _, err := root.StructuralHash(); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+}
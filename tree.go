@@ -27,10 +27,13 @@ package verkle
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"runtime"
+	"sort"
 	"sync"
 
 	"github.com/crate-crypto/go-ipa/banderwagon"
@@ -74,6 +77,7 @@ type VerkleNode interface {
 	Commitment() *Point
 
 	// Hash returns the field representation of the commitment.
+	// Its serialized form, e.g. in ToDot, is little-endian.
 	Hash() *Fr
 
 	// GetProofItems collects the various proof elements, and
@@ -153,6 +157,23 @@ func (pe *ProofElements) Merge(other *ProofElements) {
 	pe.Vals = append(pe.Vals, other.Vals...)
 }
 
+// YisBytes returns the evaluations of the proof elements in their
+// canonical encoding: 32 bytes each, little-endian, as expected by
+// verifiers that don't use go-ipa.
+func (pe *ProofElements) YisBytes() [][32]byte {
+	ret := make([][32]byte, len(pe.Yis))
+	for i, y := range pe.Yis {
+		ret[i] = y.BytesLE()
+	}
+	return ret
+}
+
+// ZisBytes returns a copy of the evaluation points of the proof
+// elements, one byte each, in the same order as YisBytes.
+func (pe *ProofElements) ZisBytes() []byte {
+	return append([]byte(nil), pe.Zis...)
+}
+
 const (
 	// These types will distinguish internal
 	// and leaf nodes when decoding from RLP.
@@ -173,6 +194,10 @@ type (
 		commitment *Point
 
 		cow map[byte]*Point
+
+		// frozen is set by Freeze, and causes all modifications
+		// made through this node to fail.
+		frozen bool
 	}
 
 	LeafNode struct {
@@ -182,12 +207,29 @@ type (
 		commitment *Point
 		c1, c2     *Point
 
+		// hash caches the commitment mapped to a scalar, it is
+		// only valid if hashValid is set. It is filled when the
+		// parent node is committed, so that Hash never modifies
+		// the leaf, and every update of the commitment must clear
+		// hashValid.
+		hash      Fr
+		hashValid bool
+
 		depth byte
 
 		// IsPOAStub indicates if this LeafNode is a proof of absence
 		// for a steam that isn't present in the tree. This flag is only
 		// true in the context of a stateless tree.
 		isPOAStub bool
+
+		// frozen is set when the tree holding the leaf is frozen,
+		// see InternalNode.Freeze.
+		frozen bool
+
+		// meta is application-defined data attached to the leaf. It
+		// is part of neither the commitment nor the serialized form,
+		// so it is lost when the leaf is flushed.
+		meta interface{}
 	}
 )
 
@@ -329,6 +371,9 @@ func (n *InternalNode) Children() []VerkleNode {
 
 // SetChild *replaces* the child at the given index with the given node.
 func (n *InternalNode) SetChild(i int, c VerkleNode) error {
+	if n.frozen {
+		return ErrFrozen
+	}
 	if i >= NodeWidth {
 		return errors.New("child index higher than node width")
 	}
@@ -347,6 +392,111 @@ func (n *InternalNode) cowChild(index byte) {
 	}
 }
 
+// PendingChildren returns the sorted indices of the children that have
+// been modified since the last call to Commit.
+func (n *InternalNode) PendingChildren() []byte {
+	pending := make([]byte, 0, len(n.cow))
+	for idx := range n.cow {
+		pending = append(pending, idx)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i] < pending[j] })
+	return pending
+}
+
+// PopulatedChildren returns the sorted indices of the children that are
+// not empty, i.e. those that are set in the bitlist of the serialized
+// node. Hashed and unknown children are included.
+func (n *InternalNode) PopulatedChildren() []int {
+	var populated []int
+	for i, child := range n.children {
+		if _, ok := child.(Empty); !ok {
+			populated = append(populated, i)
+		}
+	}
+	return populated
+}
+
+// HasPendingCommit returns true if the node has been modified since the
+// last call to Commit, i.e. if its cached commitment is stale.
+func (n *InternalNode) HasPendingCommit() bool {
+	return len(n.cow) > 0
+}
+
+// HasUnflushed reports whether the tree holds data that a call to Flush
+// would write. Flush replaces every node below the root with a hashed
+// node, so a tree is considered flushed if the root has no pending
+// changes and all its children are either hashed or empty. Nodes are
+// not tracked once resolved, so a tree that was read from but not
+// modified since the last flush is also reported as unflushed.
+func (n *InternalNode) HasUnflushed() bool {
+	if n.HasPendingCommit() {
+		return true
+	}
+	for _, child := range n.children {
+		switch child.(type) {
+		case Empty, HashedNode:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Freeze commits the tree and marks all its nodes as immutable. Any
+// subsequent modification, made through n or through one of its
+// subtrees, returns ErrFrozen. This includes TryFlush and
+// TryFlushAtDepth, which replace the flushed nodes with hashed nodes,
+// while Flush and FlushAtDepth panic. Reads with a nil resolver don't
+// modify the tree, so it can then be shared between goroutines without
+// locking. Freezing fails if the tree contains hashed or unknown nodes,
+// since reading them would require modifying the tree. Copy returns an
+// unfrozen tree.
+func (n *InternalNode) Freeze() error {
+	if err := n.checkFullyResolved(); err != nil {
+		return err
+	}
+	n.Commit()
+	n.freeze()
+	return nil
+}
+
+func (n *InternalNode) freeze() {
+	n.frozen = true
+	for _, child := range n.children {
+		switch child := child.(type) {
+		case *InternalNode:
+			child.freeze()
+		case *LeafNode:
+			child.frozen = true
+		}
+	}
+}
+
+// IsFrozen returns true if Freeze has been called on the node.
+func (n *InternalNode) IsFrozen() bool {
+	return n.frozen
+}
+
+func (n *InternalNode) checkFullyResolved() error {
+	for i, child := range n.children {
+		switch child := child.(type) {
+		case *InternalNode:
+			if err := child.checkFullyResolved(); err != nil {
+				return err
+			}
+		case HashedNode:
+			return fmt.Errorf("hashed node at depth %d, index %d: %w", n.depth+1, i, errReadFromInvalid)
+		case UnknownNode:
+			return fmt.Errorf("unknown node at depth %d, index %d: %w", n.depth+1, i, errMissingNodeInStateless)
+		case *LeafNode:
+			if child.isPOAStub {
+				return errIsPOAStub
+			}
+		}
+	}
+	return nil
+}
+
 func (n *InternalNode) Insert(key []byte, value []byte, resolver NodeResolverFn) error {
 	values := make([][]byte, NodeWidth)
 	values[key[31]] = value
@@ -354,18 +504,31 @@ func (n *InternalNode) Insert(key []byte, value []byte, resolver NodeResolverFn)
 }
 
 func (n *InternalNode) InsertValuesAtStem(stem []byte, values [][]byte, resolver NodeResolverFn) error {
+	if n.frozen {
+		return ErrFrozen
+	}
+	if len(values) != NodeWidth {
+		return fmt.Errorf("invalid number of values, expected %d, got %d", NodeWidth, len(values))
+	}
+	// Check the values before the tree gets modified, e.g. by a leaf
+	// split, so that an error leaves the tree untouched.
+	for i, v := range values {
+		if len(v) > LeafValueSize {
+			return fmt.Errorf("value at suffix %d is too long: %d > %d", i, len(v), LeafValueSize)
+		}
+	}
 	nChild := offset2key(stem, n.depth) // index of the child pointed by the next byte in the key
 
 	switch child := n.children[nChild].(type) {
 	case UnknownNode:
-		return errMissingNodeInStateless
+		return fmt.Errorf("InsertValuesAtStem at depth %d: %w", n.depth+1, errMissingNodeInStateless)
 	case Empty:
-		n.cowChild(nChild)
-		var err error
-		n.children[nChild], err = NewLeafNode(stem, values)
+		leaf, err := NewLeafNode(stem, values)
 		if err != nil {
 			return err
 		}
+		n.cowChild(nChild)
+		n.children[nChild] = leaf
 		n.children[nChild].setDepth(n.depth + 1)
 	case HashedNode:
 		if resolver == nil {
@@ -435,6 +598,9 @@ func (n *InternalNode) InsertValuesAtStem(stem []byte, values [][]byte, resolver
 // the same list, save the commitments that were consumed
 // during this call.
 func (n *InternalNode) CreatePath(path []byte, stemInfo stemInfo, comms []*Point, values [][]byte) ([]*Point, error) { // skipcq: GO-R1005
+	if n.frozen {
+		return comms, ErrFrozen
+	}
 	if len(path) == 0 {
 		return comms, errors.New("invalid path")
 	}
@@ -471,6 +637,9 @@ func (n *InternalNode) CreatePath(path []byte, stemInfo stemInfo, comms []*Point
 			if len(stemInfo.stem) != StemSize {
 				return comms, fmt.Errorf("invalid stem size %d", len(stemInfo.stem))
 			}
+			if len(values) != NodeWidth {
+				return comms, fmt.Errorf("invalid number of values for stem %x: %d", stemInfo.stem, len(values))
+			}
 			// insert stem
 			newchild := &LeafNode{
 				commitment: comms[0],
@@ -509,6 +678,9 @@ func (n *InternalNode) CreatePath(path []byte, stemInfo stemInfo, comms []*Point
 
 	switch child := n.children[path[0]].(type) {
 	case UnknownNode:
+		if len(comms) == 0 {
+			return comms, fmt.Errorf("missing commitment for internal node %x on the path of stem %x", path[:1], stemInfo.stem)
+		}
 		// create the child node if missing
 		n.children[path[0]] = NewStatelessInternal(n.depth+1, comms[0])
 		comms = comms[1:]
@@ -533,46 +705,201 @@ func (n *InternalNode) CreatePath(path []byte, stemInfo stemInfo, comms []*Point
 // The returned slice is internal to the tree, so it *must* be considered readonly
 // for callers.
 func (n *InternalNode) GetValuesAtStem(stem []byte, resolver NodeResolverFn) ([][]byte, error) {
+	leaf, err := n.getLeafAtStem(stem, resolver)
+	if err != nil || leaf == nil {
+		return nil, err
+	}
+	// We can't return the values since it's a POA leaf node, so we know nothing
+	// about its values.
+	if leaf.isPOAStub {
+		return nil, errIsPOAStub
+	}
+	return leaf.values, nil
+}
+
+// getLeafAtStem returns the leaf node of the stem, or nil if the stem
+// isn't present in the tree. Hashed nodes along the path are resolved.
+func (n *InternalNode) getLeafAtStem(stem []byte, resolver NodeResolverFn) (*LeafNode, error) {
+	leaf, err := n.getLeafOnPath(stem, resolver)
+	if err != nil || leaf == nil || !equalPaths(leaf.stem, stem) {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// getLeafOnPath returns the leaf node found by following the path of
+// stem, which can have a different stem, or nil if the path leads to
+// an empty node. Hashed nodes along the path are resolved.
+func (n *InternalNode) getLeafOnPath(stem []byte, resolver NodeResolverFn) (*LeafNode, error) {
+	// Leaves can't be deeper than the stem length.
+	return n.getLeafOnPathBounded(stem, 8*StemSize, resolver)
+}
+
+// getLeafOnPathBounded is like getLeafOnPath, but fails if the descent
+// has to go past maxDepthBits.
+func (n *InternalNode) getLeafOnPathBounded(stem []byte, maxDepthBits int, resolver NodeResolverFn) (*LeafNode, error) {
+	if 8*int(n.depth+1) > maxDepthBits {
+		return nil, fmt.Errorf("reading stem %x at depth %d: %w", stem, 8*int(n.depth+1), errDepthExceeded)
+	}
 	nchild := offset2key(stem, n.depth) // index of the child pointed by the next byte in the key
 	switch child := n.children[nchild].(type) {
 	case UnknownNode:
-		return nil, errMissingNodeInStateless
+		return nil, fmt.Errorf("reading stem at depth %d: %w", n.depth+1, errMissingNodeInStateless)
 	case Empty:
 		return nil, nil
 	case HashedNode:
-		if resolver == nil {
-			return nil, fmt.Errorf("hashed node %x at depth %d along stem %x could not be resolved: %w", child.Commitment().Bytes(), n.depth, stem, errReadFromInvalid)
-		}
-		serialized, err := resolver(stem[:n.depth+1])
-		if err != nil {
-			return nil, fmt.Errorf("resolving node %x at depth %d: %w", stem, n.depth, err)
+		if err := n.resolveChild(stem, resolver); err != nil {
+			return nil, err
 		}
-		resolved, err := ParseNode(serialized, n.depth+1)
-		if err != nil {
-			return nil, fmt.Errorf("verkle tree: error parsing resolved node %x: %w", stem, err)
-		}
-		n.children[nchild] = resolved
 		// recurse to handle the case of a LeafNode child that
 		// splits.
-		return n.GetValuesAtStem(stem, resolver)
+		return n.getLeafOnPathBounded(stem, maxDepthBits, resolver)
 	case *LeafNode:
-		if equalPaths(child.stem, stem) {
-			// We can't return the values since it's a POA leaf node, so we know nothing
-			// about its values.
-			if child.isPOAStub {
-				return nil, errIsPOAStub
+		return child, nil
+	case *InternalNode:
+		return child.getLeafOnPathBounded(stem, maxDepthBits, resolver)
+	default:
+		return nil, errUnknownNodeType
+	}
+}
+
+// ResolutionPath returns the paths that a read of key will pass to the
+// resolver, as far as they can be known without resolving anything. A
+// hashed node doesn't tell what is below it, so this is at most the path
+// of the first hashed node along key, and nil if the read doesn't need
+// the resolver at all. Once that node has been fetched and the tree
+// populated, ResolutionPath can be called again for the next one.
+func (n *InternalNode) ResolutionPath(key []byte) [][]byte {
+	switch child := n.children[offset2key(key, n.depth)].(type) {
+	case HashedNode:
+		return [][]byte{append([]byte(nil), key[:n.depth+1]...)}
+	case *InternalNode:
+		return child.ResolutionPath(key)
+	default:
+		return nil
+	}
+}
+
+// resolveChild replaces the hashed child of n along the path of stem
+// with the node returned by resolver.
+func (n *InternalNode) resolveChild(stem []byte, resolver NodeResolverFn) error {
+	if resolver == nil {
+		return fmt.Errorf("hashed node at depth %d along stem %x could not be resolved: %w", n.depth, stem, errReadFromInvalid)
+	}
+	serialized, err := resolver(stem[:n.depth+1])
+	if err != nil {
+		return fmt.Errorf("resolving node %x at depth %d: %w", stem, n.depth, err)
+	}
+	resolved, err := ParseNode(serialized, n.depth+1)
+	if err != nil {
+		return fmt.Errorf("verkle tree: error parsing resolved node %x: %w", stem, err)
+	}
+	n.children[offset2key(stem, n.depth)] = resolved
+	return nil
+}
+
+// Partition splits keys into those that have a value in the tree and
+// those that don't, keeping the original order within each group. The
+// keys are sorted first, so that the nodes shared by several keys are
+// only visited once. Hashed nodes along the way are resolved.
+func (n *InternalNode) Partition(keys [][]byte, resolver NodeResolverFn) (present, absent [][]byte, err error) {
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		if len(key) != StemSize+1 {
+			return nil, nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+		}
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(keys[order[a]], keys[order[b]]) < 0
+	})
+
+	found := make([]bool, len(keys))
+	if err := n.partition(keys, order, found, resolver); err != nil {
+		return nil, nil, err
+	}
+	for i, key := range keys {
+		if found[i] {
+			present = append(present, key)
+		} else {
+			absent = append(absent, key)
+		}
+	}
+	return present, absent, nil
+}
+
+// partition sets found[i] for each index i in order, which is sorted by
+// key, whose key has a value below n.
+func (n *InternalNode) partition(keys [][]byte, order []int, found []bool, resolver NodeResolverFn) error {
+	for len(order) > 0 {
+		// Gather the keys that go through the same child.
+		nChild := offset2key(keys[order[0]], n.depth)
+		end := 1
+		for end < len(order) && offset2key(keys[order[end]], n.depth) == nChild {
+			end++
+		}
+		group := order[:end]
+		order = order[end:]
+
+		if _, ok := n.children[nChild].(HashedNode); ok {
+			if err := n.resolveChild(keys[group[0]], resolver); err != nil {
+				return err
 			}
-			return child.values, nil
 		}
-		return nil, nil
+		switch child := n.children[nChild].(type) {
+		case Empty:
+		case UnknownNode:
+			return fmt.Errorf("Partition at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+		case *LeafNode:
+			for _, i := range group {
+				if !equalPaths(child.stem, keys[i]) {
+					continue
+				}
+				if child.isPOAStub {
+					return errIsPOAStub
+				}
+				found[i] = child.values[keys[i][StemSize]] != nil
+			}
+		case *InternalNode:
+			if err := child.partition(keys, group, found, resolver); err != nil {
+				return err
+			}
+		default:
+			return errUnknownNodeType
+		}
+	}
+	return nil
+}
+
+// KeyDepth returns the depth, in bits, of the leaf holding key, or of
+// the slot that the descent for key ended in if no such leaf exists,
+// and whether a value is present at key. Nodes are not resolved: an
+// error is returned if a hashed or unknown node blocks the descent.
+func (n *InternalNode) KeyDepth(key []byte) (depthBits int, found bool, err error) {
+	if len(key) != StemSize+1 {
+		return 0, false, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+	}
+	switch child := n.children[offset2key(key, n.depth)].(type) {
+	case Empty:
+		return 8 * int(n.depth+1), false, nil
+	case HashedNode:
+		return 0, false, fmt.Errorf("hashed node at depth %d along key %x: %w", n.depth+1, key, errReadFromInvalid)
+	case UnknownNode:
+		return 0, false, fmt.Errorf("reading key at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+	case *LeafNode:
+		found = equalPaths(child.stem, key) && child.values[key[StemSize]] != nil
+		return 8 * int(child.depth), found, nil
 	case *InternalNode:
-		return child.GetValuesAtStem(stem, resolver)
+		return child.KeyDepth(key)
 	default:
-		return nil, errUnknownNodeType
+		return 0, false, errUnknownNodeType
 	}
 }
 
 func (n *InternalNode) Delete(key []byte, resolver NodeResolverFn) (bool, error) {
+	if n.frozen {
+		return false, ErrFrozen
+	}
 	nChild := offset2key(key, n.depth)
 	switch child := n.children[nChild].(type) {
 	case Empty:
@@ -609,7 +936,7 @@ func (n *InternalNode) Delete(key []byte, resolver NodeResolverFn) (bool, error)
 			// as well.
 			for _, c := range n.children {
 				if _, ok := c.(Empty); !ok {
-					break
+					return false, nil
 				}
 			}
 
@@ -620,10 +947,100 @@ func (n *InternalNode) Delete(key []byte, resolver NodeResolverFn) (bool, error)
 	}
 }
 
+// DeletionFootprint returns the paths of the nodes that deleting key
+// would remove from the tree, deepest first: the leaf if key holds its
+// last value, then each internal node that would be left without any
+// children. The root is never included. Nodes are not collapsed upon
+// deletion, so no other node is affected. The tree isn't modified:
+// hashed nodes along the path of key are resolved, but not attached.
+func (n *InternalNode) DeletionFootprint(key []byte, resolver NodeResolverFn) ([][]byte, error) {
+	if len(key) != StemSize+1 {
+		return nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+	}
+	removed, _, err := n.deletionFootprint(key, resolver)
+	return removed, err
+}
+
+// deletionFootprint returns the paths of the nodes below n that deleting
+// key would remove, and whether n itself would be left empty.
+func (n *InternalNode) deletionFootprint(key []byte, resolver NodeResolverFn) ([][]byte, bool, error) {
+	nChild := offset2key(key, n.depth)
+	child := n.children[nChild]
+	if _, ok := child.(HashedNode); ok {
+		if resolver == nil {
+			return nil, false, errDeleteHash
+		}
+		payload, err := resolver(key[:n.depth+1])
+		if err != nil {
+			return nil, false, err
+		}
+		if child, err = ParseNode(payload, n.depth+1); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var (
+		removed      [][]byte
+		childRemoved bool
+	)
+	switch child := child.(type) {
+	case Empty:
+		return nil, false, nil
+	case UnknownNode:
+		return nil, false, fmt.Errorf("DeletionFootprint at depth %d: %w", n.depth+1, errMissingNodeInStateless)
+	case *LeafNode:
+		if !equalPaths(child.stem, key) || child.values[key[StemSize]] == nil {
+			return nil, false, nil
+		}
+		childRemoved = true
+		for i, v := range child.values {
+			if v != nil && byte(i) != key[StemSize] {
+				childRemoved = false
+				break
+			}
+		}
+	case *InternalNode:
+		var err error
+		if removed, childRemoved, err = child.deletionFootprint(key, resolver); err != nil {
+			return nil, false, err
+		}
+	default:
+		return nil, false, errUnknownNodeType
+	}
+	if !childRemoved {
+		return removed, false, nil
+	}
+
+	removed = append(removed, append([]byte(nil), key[:n.depth+1]...))
+	for i, c := range n.children {
+		if _, ok := c.(Empty); !ok && i != int(nChild) {
+			return removed, false, nil
+		}
+	}
+	return removed, true, nil
+}
+
 // Flush hashes the children of an internal node and replaces them
 // with HashedNode. It also sends the current node on the flush channel.
+// It panics if the tree is frozen, see TryFlush.
 func (n *InternalNode) Flush(flush NodeFlushFn) {
-	//
+	if err := n.TryFlush(flush); err != nil {
+		panic(err)
+	}
+}
+
+// TryFlush is like Flush, but returns ErrFrozen instead of panicking
+// if any node of the tree is frozen. The check is made before anything
+// is flushed, so the tree is left untouched in that case.
+func (n *InternalNode) TryFlush(flush NodeFlushFn) error {
+	if n.hasFrozenNode() {
+		return ErrFrozen
+	}
+	n.flush(flush)
+	return nil
+}
+
+func (n *InternalNode) flush(flush NodeFlushFn) {
 	var (
 		path                []byte
 		flushAndCapturePath = func(p []byte, vn VerkleNode) {
@@ -641,7 +1058,7 @@ func (n *InternalNode) Flush(flush NodeFlushFn) {
 	for i, child := range n.children {
 		if c, ok := child.(*InternalNode); ok {
 			c.Commit()
-			c.Flush(flushAndCapturePath)
+			c.flush(flushAndCapturePath)
 			n.children[i] = HashedNode{}
 		} else if c, ok := child.(*LeafNode); ok {
 			c.Commit()
@@ -654,8 +1071,27 @@ func (n *InternalNode) Flush(flush NodeFlushFn) {
 
 // FlushAtDepth goes over all internal nodes of a given depth, and
 // flushes them to disk. Its purpose it to free up space if memory
-// is running scarce.
+// is running scarce. It panics if the tree is frozen, see
+// TryFlushAtDepth.
 func (n *InternalNode) FlushAtDepth(depth uint8, flush NodeFlushFn) {
+	if err := n.TryFlushAtDepth(depth, flush); err != nil {
+		panic(err)
+	}
+}
+
+// TryFlushAtDepth is like FlushAtDepth, but returns ErrFrozen instead
+// of panicking if any node of the tree is frozen. The check is made
+// before anything is flushed, so the tree is left untouched in that
+// case.
+func (n *InternalNode) TryFlushAtDepth(depth uint8, flush NodeFlushFn) error {
+	if n.hasFrozenNode() {
+		return ErrFrozen
+	}
+	n.flushAtDepth(depth, flush)
+	return nil
+}
+
+func (n *InternalNode) flushAtDepth(depth uint8, flush NodeFlushFn) {
 	for i, child := range n.children {
 		// Skip non-internal nodes
 		c, ok := child.(*InternalNode)
@@ -670,16 +1106,37 @@ func (n *InternalNode) FlushAtDepth(depth uint8, flush NodeFlushFn) {
 
 		// Not deep enough, recurse
 		if n.depth < depth {
-			c.FlushAtDepth(depth, flush)
+			c.flushAtDepth(depth, flush)
 			continue
 		}
 
 		child.Commit()
-		c.Flush(flush)
+		c.flush(flush)
 		n.children[i] = HashedNode{}
 	}
 }
 
+// hasFrozenNode reports whether n or any node below it is frozen. A
+// subtree can be frozen on its own, so checking n isn't enough.
+func (n *InternalNode) hasFrozenNode() bool {
+	if n.frozen {
+		return true
+	}
+	for _, child := range n.children {
+		switch child := child.(type) {
+		case *InternalNode:
+			if child.hasFrozenNode() {
+				return true
+			}
+		case *LeafNode:
+			if child.frozen {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (n *InternalNode) Get(key []byte, resolver NodeResolverFn) ([]byte, error) {
 	if len(key) != StemSize+1 {
 		return nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
@@ -700,12 +1157,140 @@ func (n *InternalNode) Get(key []byte, resolver NodeResolverFn) ([]byte, error)
 	return stemValues[key[StemSize]], nil
 }
 
+// LeafMeta returns the application-defined data attached to the leaf
+// of stem, or nil if there is none or if the stem isn't present.
+func (n *InternalNode) LeafMeta(stem []byte, resolver NodeResolverFn) (interface{}, error) {
+	leaf, err := n.getLeafAtStem(stem, resolver)
+	if err != nil || leaf == nil {
+		return nil, err
+	}
+	return leaf.meta, nil
+}
+
+// SetLeafMeta attaches application-defined data to the leaf of stem.
+// See LeafNode.SetMeta. An error is returned if the stem isn't present.
+func (n *InternalNode) SetLeafMeta(stem []byte, meta interface{}, resolver NodeResolverFn) error {
+	if n.frozen {
+		return ErrFrozen
+	}
+	leaf, err := n.getLeafAtStem(stem, resolver)
+	if err != nil {
+		return err
+	}
+	if leaf == nil {
+		return fmt.Errorf("no leaf at stem %x", stem)
+	}
+	leaf.meta = meta
+	return nil
+}
+
+// GetBounded is like Get, but returns an error wrapping errDepthExceeded
+// instead of descending past maxDepthBits, which lets callers guard
+// against keys that end up unexpectedly deep in the tree. The depth of
+// a node is counted in bits, i.e. 8 per level, so that a leaf right
+// below the root is at depth 8.
+func (n *InternalNode) GetBounded(key []byte, maxDepthBits int, resolver NodeResolverFn) ([]byte, error) {
+	if len(key) != StemSize+1 {
+		return nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+	}
+	leaf, err := n.getLeafOnPathBounded(key[:StemSize], maxDepthBits, resolver)
+	if err != nil || leaf == nil || !equalPaths(leaf.stem, key) {
+		return nil, err
+	}
+	if leaf.isPOAStub {
+		return nil, errIsPOAStub
+	}
+	return leaf.values[key[StemSize]], nil
+}
+
+// GetDetailed returns the value at key. If the stem of key isn't in
+// the tree, but its path leads to a leaf with another stem, that stem
+// is also returned: this is the stem that a proof of absence for key
+// refers to. storedStem is nil if the stem of key is present, or if its
+// path leads to an empty node.
+func (n *InternalNode) GetDetailed(key []byte, resolver NodeResolverFn) (value []byte, storedStem []byte, err error) {
+	if len(key) != StemSize+1 {
+		return nil, nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+	}
+	leaf, err := n.getLeafOnPath(key[:StemSize], resolver)
+	if err != nil || leaf == nil {
+		return nil, nil, err
+	}
+	if !equalPaths(leaf.stem, key) {
+		return nil, leaf.stem, nil
+	}
+	if leaf.isPOAStub {
+		return nil, nil, errIsPOAStub
+	}
+	return leaf.values[key[StemSize]], nil, nil
+}
+
+// GetWithLeafCommitment returns the value at key, along with the
+// commitment of the suffix tree that it belongs to: C1 for suffixes
+// lower than 128, C2 otherwise. Both are nil if the stem isn't present
+// in the tree. An error is returned if the leaf is a proof of absence
+// stub, since neither its values nor its suffix commitments are known.
+func (n *InternalNode) GetWithLeafCommitment(key []byte, resolver NodeResolverFn) ([]byte, *Point, error) {
+	if len(key) != StemSize+1 {
+		return nil, nil, fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+	}
+	leaf, err := n.getLeafAtStem(key[:StemSize], resolver)
+	if err != nil || leaf == nil {
+		return nil, nil, err
+	}
+	if leaf.isPOAStub {
+		return nil, nil, errIsPOAStub
+	}
+	suffix := key[StemSize]
+	if suffix < NodeWidth/2 {
+		return leaf.values[suffix], leaf.c1, nil
+	}
+	return leaf.values[suffix], leaf.c2, nil
+}
+
+// SubtreeCommitment commits to, and returns the commitment of, the
+// internal node found by following path from n. Each byte of path is
+// the index of a child. The path can not lead to a leaf node or go
+// through a hashed node.
+func (n *InternalNode) SubtreeCommitment(path []byte) (*Point, error) {
+	node := n
+	for i, idx := range path {
+		switch child := node.children[idx].(type) {
+		case *InternalNode:
+			node = child
+		case Empty:
+			if i == len(path)-1 {
+				return child.Commitment(), nil
+			}
+			return nil, fmt.Errorf("path %x goes through an empty node at depth %d", path, node.depth+1)
+		case *LeafNode:
+			return nil, fmt.Errorf("path %x leads to a leaf node at depth %d", path, node.depth+1)
+		case HashedNode:
+			return nil, fmt.Errorf("path %x goes through a hashed node at depth %d: %w", path, node.depth+1, errReadFromInvalid)
+		case UnknownNode:
+			return nil, fmt.Errorf("SubtreeCommitment at depth %d: %w", node.depth+1, errMissingNodeInStateless)
+		default:
+			return nil, errUnknownNodeType
+		}
+	}
+	return node.Commit(), nil
+}
+
 func (n *InternalNode) Hash() *Fr {
 	var hash Fr
 	n.Commitment().MapToScalarField(&hash)
 	return &hash
 }
 
+// CommitAndHash commits the pending changes of the tree and returns the
+// hash of the resulting root commitment, that is, what Hash would return
+// after Commit.
+func (n *InternalNode) CommitAndHash() *Fr {
+	var hash Fr
+	n.Commit().MapToScalarField(&hash)
+	return &hash
+}
+
 func (n *InternalNode) Commitment() *Point {
 	if n.commitment == nil {
 		panic("nil commitment")
@@ -724,8 +1309,22 @@ func (n *InternalNode) fillLevels(levels [][]*InternalNode) {
 }
 
 func (n *InternalNode) Commit() *Point {
+	comm, err := n.CommitCtx(context.Background())
+	if err != nil {
+		// TODO: make Commit() return an error
+		panic(err)
+	}
+	return comm
+}
+
+// CommitCtx is like Commit, but stops early if ctx is cancelled. Nodes
+// are committed one level at a time, starting with the deepest one, and
+// ctx is checked before each level. The levels that were committed
+// before the cancellation are kept, so a later call only has to commit
+// the remaining ones.
+func (n *InternalNode) CommitCtx(ctx context.Context) (*Point, error) {
 	if len(n.cow) == 0 {
-		return n.commitment
+		return n.commitment, nil
 	}
 
 	internalNodeLevels := make([][]*InternalNode, StemSize)
@@ -736,15 +1335,21 @@ func (n *InternalNode) Commit() *Point {
 		if len(nodes) == 0 {
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		minBatchSize := 4
 		if len(nodes) <= minBatchSize {
 			if err := commitNodesAtLevel(nodes); err != nil {
-				// TODO: make Commit() return an error
-				panic(err)
+				return nil, err
 			}
 		} else {
-			var wg sync.WaitGroup
+			var (
+				wg       sync.WaitGroup
+				errMu    sync.Mutex
+				batchErr error
+			)
 			numBatches := runtime.NumCPU()
 			batchSize := (len(nodes) + numBatches - 1) / numBatches
 			if batchSize < minBatchSize {
@@ -760,21 +1365,25 @@ func (n *InternalNode) Commit() *Point {
 				go func() {
 					defer wg.Done()
 					if err := commitNodesAtLevel(nodes[start:end]); err != nil {
-						// TODO: make Commit() return an error
-						panic(err)
+						errMu.Lock()
+						batchErr = err
+						errMu.Unlock()
 					}
-
 				}()
 			}
 			wg.Wait()
+			if batchErr != nil {
+				return nil, batchErr
+			}
 		}
 	}
-	return n.commitment
+	return n.commitment, nil
 }
 
 func commitNodesAtLevel(nodes []*InternalNode) error {
 	points := make([]*Point, 0, 1024)
 	cowIndexes := make([]int, 0, 1024)
+	children := make([]VerkleNode, 0, 1024)
 
 	// For each internal node, we collect in `points` all the ones we need to map to a field element.
 	// That is, for each touched children in a node, we collect the old and new commitment to do the diff updating
@@ -784,6 +1393,7 @@ func commitNodesAtLevel(nodes []*InternalNode) error {
 			points = append(points, nodeChildComm)
 			points = append(points, node.children[idx].Commitment())
 			cowIndexes = append(cowIndexes, int(idx))
+			children = append(children, node.children[idx])
 		}
 	}
 
@@ -798,6 +1408,13 @@ func commitNodesAtLevel(nodes []*InternalNode) error {
 		return fmt.Errorf("batch mapping to scalar fields: %s", err)
 	}
 
+	// The hashes of the touched leaves have just been computed, cache them.
+	for i, child := range children {
+		if leaf, ok := child.(*LeafNode); ok {
+			leaf.hash, leaf.hashValid = *frs[2*i+1], true
+		}
+	}
+
 	// We calculate the difference between each (new commitment - old commitment) pair, and store it
 	// in the same slice to avoid allocations.
 	for i := 0; i < len(frs); i += 2 {
@@ -928,7 +1545,7 @@ func (n *InternalNode) GetProofItems(keys keylist, resolver NodeResolverFn) (*Pr
 
 		if _, isunknown := n.children[childIdx].(UnknownNode); isunknown {
 			// TODO: add a test case to cover this scenario.
-			return nil, nil, nil, errMissingNodeInStateless
+			return nil, nil, nil, fmt.Errorf("GetProofItems at depth %d: %w", n.depth+1, errMissingNodeInStateless)
 		}
 
 		// Special case of a proof of absence: no children
@@ -987,6 +1604,19 @@ func (n *InternalNode) Serialize() ([]byte, error) {
 	return ret, nil
 }
 
+// SerializeTo writes the serialized form of the node, as returned by
+// Serialize, to w. Unlike leaves, internal nodes are buffered: their
+// serialized form has a fixed size of less than a hundred bytes, so it is
+// written with a single call to w.Write.
+func (n *InternalNode) SerializeTo(w io.Writer) error {
+	serialized, err := n.Serialize()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(serialized)
+	return err
+}
+
 func (n *InternalNode) Copy() VerkleNode {
 	ret := &InternalNode{
 		children:   make([]VerkleNode, len(n.children)),
@@ -1013,6 +1643,51 @@ func (n *InternalNode) Copy() VerkleNode {
 	return ret
 }
 
+// SimulateInsert returns the root commitment that the tree would have
+// after inserting value at key, without modifying the tree. Pending
+// changes are committed first. Only the nodes along the path of key are
+// copied, the rest of the tree is shared with the copy.
+func (n *InternalNode) SimulateInsert(key []byte, value []byte, resolver NodeResolverFn) (*Point, error) {
+	n.Commit()
+	root := n.copyPath(key)
+	if err := root.Insert(key, value, resolver); err != nil {
+		return nil, err
+	}
+	return root.Commit(), nil
+}
+
+// copyPath returns a copy of n in which the nodes along the path of key
+// are copied, and every other child is shared with n. It must only be
+// called on a committed tree.
+func (n *InternalNode) copyPath(key []byte) *InternalNode {
+	ret := &InternalNode{
+		children:   make([]VerkleNode, len(n.children)),
+		commitment: new(Point).Set(n.commitment),
+		depth:      n.depth,
+	}
+	copy(ret.children, n.children)
+
+	nChild := offset2key(key, n.depth)
+	switch child := n.children[nChild].(type) {
+	case *InternalNode:
+		ret.children[nChild] = child.copyPath(key)
+	case *LeafNode:
+		// Values are replaced, never modified in place, so they can
+		// be shared. The commitments are updated in place, though.
+		leaf := *child
+		leaf.frozen = false
+		leaf.values = make([][]byte, len(child.values))
+		copy(leaf.values, child.values)
+		for _, p := range []**Point{&leaf.commitment, &leaf.c1, &leaf.c2} {
+			if *p != nil {
+				*p = new(Point).Set(*p)
+			}
+		}
+		ret.children[nChild] = &leaf
+	}
+	return ret
+}
+
 func (n *InternalNode) toDot(parent, path string) string {
 	me := fmt.Sprintf("internal%s", path)
 	var hash Fr
@@ -1063,6 +1738,9 @@ func (n *InternalNode) touchCoW(index byte) {
 }
 
 func (n *LeafNode) Insert(key []byte, value []byte, _ NodeResolverFn) error {
+	if n.frozen {
+		return ErrFrozen
+	}
 	if n.isPOAStub {
 		return errIsPOAStub
 	}
@@ -1079,6 +1757,9 @@ func (n *LeafNode) Insert(key []byte, value []byte, _ NodeResolverFn) error {
 }
 
 func (n *LeafNode) insertMultiple(stem []byte, values [][]byte) error {
+	if n.frozen {
+		return ErrFrozen
+	}
 	// Sanity check: ensure the stems are the same.
 	if !equalPaths(stem, n.stem) {
 		return errInsertIntoOtherStem
@@ -1098,6 +1779,7 @@ func (n *LeafNode) updateC(cxIndex int, newC Fr, oldC Fr) {
 
 	// Add delta to the current commitment.
 	n.commitment.Add(n.commitment, cfg.CommitToPoly(poly[:], 0))
+	n.hashValid = false
 }
 
 func (n *LeafNode) updateCn(index byte, value []byte, c *Point) error {
@@ -1165,6 +1847,16 @@ func (n *LeafNode) updateLeaf(index byte, value []byte) error {
 }
 
 func (n *LeafNode) updateMultipleLeaves(values [][]byte) error { // skipcq: GO-R1005
+	if len(values) != NodeWidth {
+		return fmt.Errorf("invalid number of values, expected %d, got %d", NodeWidth, len(values))
+	}
+	// Check the values before C1 or C2 get updated, so that an error
+	// doesn't leave the leaf half-updated.
+	for i, v := range values {
+		if len(v) > LeafValueSize {
+			return fmt.Errorf("value at suffix %d is too long: %d > %d", i, len(v), LeafValueSize)
+		}
+	}
 	var oldC1, oldC2 *Point
 
 	// We iterate the values, and we update the C1 and/or C2 commitments depending on the index.
@@ -1230,6 +1922,9 @@ func (n *LeafNode) updateMultipleLeaves(values [][]byte) error { // skipcq: GO-R
 // Delete deletes a value from the leaf, return `true` as a second
 // return value, if the parent should entirely delete the child.
 func (n *LeafNode) Delete(k []byte, _ NodeResolverFn) (bool, error) {
+	if n.frozen {
+		return false, ErrFrozen
+	}
 	// Sanity check: ensure the key header is the same:
 	if !equalPaths(k, n.stem) {
 		return false, nil
@@ -1295,12 +1990,15 @@ func (n *LeafNode) Delete(k []byte, _ NodeResolverFn) (bool, error) {
 		var poly [4]Fr
 		cn.MapToScalarField(&poly[subtreeindex])
 		n.commitment.Sub(n.commitment, cfg.CommitToPoly(poly[:], 0))
+		n.hashValid = false
 
-		// Clear the corresponding commitment
+		// Reset the corresponding commitment to the commitment of
+		// an empty suffix tree, so that values can be written to it
+		// again and the leaf can still be serialized.
 		if k[31] < 128 {
-			n.c1 = nil
+			n.c1 = new(Point).SetIdentity()
 		} else {
-			n.c2 = nil
+			n.c2 = new(Point).SetIdentity()
 		}
 
 		return false, nil
@@ -1337,9 +2035,10 @@ func (n *LeafNode) Get(k []byte, _ NodeResolverFn) ([]byte, error) {
 }
 
 func (n *LeafNode) Hash() *Fr {
-	// TODO cache this in a subsequent PR, not done here
-	// to reduce complexity.
-	// TODO use n.commitment once all Insert* are diff-inserts
+	if n.hashValid {
+		hash := n.hash
+		return &hash
+	}
 	var hash Fr
 	n.Commitment().MapToScalarField(&hash)
 	return &hash
@@ -1404,6 +2103,37 @@ func leafToComms(poly []Fr, val []byte) error {
 	return nil
 }
 
+// ProveSuffixes returns the openings needed to prove the values at the
+// given suffixes of the leaf, missing values included: the extension
+// openings, and the C1 and/or C2 openings of each suffix. Duplicate
+// suffixes are only proven once. The openings of the internal nodes
+// above the leaf are not included.
+func (n *LeafNode) ProveSuffixes(suffixes []byte) (*ProofElements, error) {
+	if len(suffixes) == 0 {
+		return nil, errors.New("no suffix to prove")
+	}
+	if n.isPOAStub {
+		return nil, fmt.Errorf("proving suffixes of leaf %x: %w", n.stem, errIsPOAStub)
+	}
+
+	var seen [NodeWidth]bool
+	keys := make(keylist, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		if seen[suffix] {
+			continue
+		}
+		seen[suffix] = true
+		keys = append(keys, append(append(make([]byte, 0, StemSize+1), n.stem...), suffix))
+	}
+	sort.Sort(keys)
+
+	pe, _, _, err := n.GetProofItems(keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pe, nil
+}
+
 func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements, []byte, [][]byte, error) { // skipcq: GO-R1005
 	var (
 		poly [NodeWidth]Fr // top-level polynomial
@@ -1557,7 +2287,48 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 // The format is: <nodeType><stem><bitlist><comm><c1comm><c2comm><children...>
 func (n *LeafNode) Serialize() ([]byte, error) {
 	cBytes := banderwagon.BatchToBytesUncompressed(n.commitment, n.c1, n.c2)
-	return n.serializeLeafWithUncompressedCommitments(cBytes[0], cBytes[1], cBytes[2]), nil
+	return n.serializeLeafWithUncompressedCommitments(cBytes[0], cBytes[1], cBytes[2])
+}
+
+// SerializeTo writes the serialized form of the leaf, as returned by
+// Serialize, to w. Values are written one at a time instead of being
+// gathered in a buffer first.
+func (n *LeafNode) SerializeTo(w io.Writer) error {
+	cBytes := banderwagon.BatchToBytesUncompressed(n.commitment, n.c1, n.c2)
+
+	var header [leafChildrenOffset]byte
+	header[nodeTypeOffset] = leafRLPType
+	copy(header[leafSteamOffset:], n.stem[:StemSize])
+	for i, v := range n.values {
+		if v != nil {
+			setBit(header[leafBitlistOffset:leafCommitmentOffset], i)
+		}
+	}
+	copy(header[leafCommitmentOffset:], cBytes[0][:])
+	copy(header[leafC1CommitmentOffset:], cBytes[1][:])
+	copy(header[leafC2CommitmentOffset:], cBytes[2][:])
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	// Values are padded to LeafValueSize.
+	var value [LeafValueSize]byte
+	for i, v := range n.values {
+		if v == nil {
+			continue
+		}
+		if len(v) > LeafValueSize {
+			return fmt.Errorf("value at suffix %d is too long: %d > %d", i, len(v), LeafValueSize)
+		}
+		copy(value[:], v)
+		for j := len(v); j < LeafValueSize; j++ {
+			value[j] = 0
+		}
+		if _, err := w.Write(value[:]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (n *LeafNode) Copy() VerkleNode {
@@ -1567,8 +2338,12 @@ func (n *LeafNode) Copy() VerkleNode {
 	l.depth = n.depth
 	copy(l.stem, n.stem)
 	for i, v := range n.values {
-		l.values[i] = make([]byte, len(v))
-		copy(l.values[i], v)
+		// Keep missing values missing, as an empty value would be
+		// serialized and reported as present.
+		if v != nil {
+			l.values[i] = make([]byte, len(v))
+			copy(l.values[i], v)
+		}
 	}
 	if n.commitment != nil {
 		l.commitment = new(Point)
@@ -1582,11 +2357,26 @@ func (n *LeafNode) Copy() VerkleNode {
 		l.c2 = new(Point)
 		l.c2.Set(n.c2)
 	}
+	l.hash, l.hashValid = n.hash, n.hashValid
 	l.isPOAStub = n.isPOAStub
+	l.meta = n.meta
 
 	return l
 }
 
+// Meta returns the application-defined data attached to the leaf with
+// SetMeta, or nil.
+func (n *LeafNode) Meta() interface{} {
+	return n.meta
+}
+
+// SetMeta attaches application-defined data to the leaf, replacing any
+// previous one. It doesn't affect the commitment of the leaf, isn't
+// serialized, and is shared, not copied, by Copy.
+func (n *LeafNode) SetMeta(meta interface{}) {
+	n.meta = meta
+}
+
 func (n *LeafNode) Key(i int) []byte {
 	var ret [32]byte
 	copy(ret[:], n.stem)
@@ -1604,7 +2394,7 @@ func (n *LeafNode) Value(i int) []byte {
 func (n *LeafNode) toDot(parent, path string) string {
 	var hash Fr
 	n.Commitment().MapToScalarField(&hash)
-	ret := fmt.Sprintf("leaf%s [label=\"L: %x\nC: %x\nC₁: %x\nC₂:%x\"]\n%s -> leaf%s\n", path, hash.Bytes(), n.commitment.Bytes(), n.c1.Bytes(), n.c2.Bytes(), parent, path)
+	ret := fmt.Sprintf("leaf%s [label=\"L: %x\nC: %x\nC₁: %x\nC₂:%x\"]\n%s -> leaf%s\n", path, hash.BytesLE(), n.commitment.Bytes(), n.c1.Bytes(), n.c2.Bytes(), parent, path)
 	for i, v := range n.values {
 		if len(v) != 0 {
 			ret = fmt.Sprintf("%sval%s%02x [label=\"%x\"]\nleaf%s -> val%s%02x\n", ret, path, i, v, path, path, i)
@@ -1621,10 +2411,40 @@ func (n *LeafNode) Values() [][]byte {
 	return n.values
 }
 
+// SetValue writes value at key in the leaf, without updating any of the
+// leaf's commitments. It is meant to rebuild a leaf whose commitments are
+// already known, e.g. from a verified witness: using it in any other
+// context leaves the leaf with commitments that don't match its values.
+// Use Insert to also update the commitments.
+func (n *LeafNode) SetValue(key, value []byte) error {
+	if n.frozen {
+		return ErrFrozen
+	}
+	if len(key) != StemSize+1 {
+		return fmt.Errorf("invalid key length, expected %d, got %d", StemSize+1, len(key))
+	}
+	if !equalPaths(n.stem, key) {
+		return fmt.Errorf("key %x does not belong to the leaf with stem %x: %w", key, n.stem, errInsertIntoOtherStem)
+	}
+	if n.isPOAStub {
+		return errIsPOAStub
+	}
+	if len(value) > LeafValueSize {
+		return fmt.Errorf("value is too long: %d > %d", len(value), LeafValueSize)
+	}
+	n.values[key[StemSize]] = value
+	return nil
+}
+
 func setBit(bitlist []byte, index int) {
 	bitlist[index/8] |= mask[index%8]
 }
 
+// ToDot commits to the tree and returns its representation in the DOT
+// language. Nodes are labelled with their hash, i.e. the field
+// representation of their commitment, in little-endian form like all
+// field elements in the spec. Commitments are printed in their
+// compressed form, as used in proofs.
 func ToDot(root VerkleNode) string {
 	root.Commit()
 	return fmt.Sprintf("digraph D {\n%s}", root.toDot("", ""))
@@ -1692,11 +2512,15 @@ func (n *InternalNode) BatchSerialize() ([]SerializedNode, error) {
 			cBytes := serializedPoints[idx]
 			c1Bytes := serializedPoints[idx+1]
 			c2Bytes := serializedPoints[idx+2]
+			serialized, err := n.serializeLeafWithUncompressedCommitments(cBytes, c1Bytes, c2Bytes)
+			if err != nil {
+				return nil, err
+			}
 			sn := SerializedNode{
 				Node:            n,
 				Path:            paths[i],
 				CommitmentBytes: serializedPoints[idx],
-				SerializedBytes: n.serializeLeafWithUncompressedCommitments(cBytes, c1Bytes, c2Bytes),
+				SerializedBytes: serialized,
 			}
 			ret = append(ret, sn)
 			idx += 3
@@ -1706,6 +2530,73 @@ func (n *InternalNode) BatchSerialize() ([]SerializedNode, error) {
 	return ret, nil
 }
 
+// RebuildFromFlush rebuilds a tree from the nodes captured from Flush
+// or BatchSerialize, without going through a database. The nodes are
+// indexed by path, the root being the node with an empty path. Each
+// node is deserialized from SerializedBytes, or from Node if it is
+// missing. An error is returned if a node referenced by its parent
+// is not part of the stream.
+func RebuildFromFlush(nodes []SerializedNode) (*InternalNode, error) {
+	byPath := make(map[string][]byte, len(nodes))
+	for _, node := range nodes {
+		serialized := node.SerializedBytes
+		if serialized == nil {
+			if node.Node == nil {
+				return nil, fmt.Errorf("node at path %x has no content", node.Path)
+			}
+			var err error
+			serialized, err = node.Node.Serialize()
+			if err != nil {
+				return nil, fmt.Errorf("serializing node at path %x: %w", node.Path, err)
+			}
+		}
+		byPath[string(node.Path)] = serialized
+	}
+
+	serializedRoot, ok := byPath[""]
+	if !ok {
+		return nil, errors.New("root node is missing from the flushed nodes")
+	}
+	root, err := ParseNode(serializedRoot, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing root node: %w", err)
+	}
+	rootNode, ok := root.(*InternalNode)
+	if !ok {
+		return nil, errors.New("root node is not an internal node")
+	}
+	if err := rootNode.resolveAll(nil, byPath); err != nil {
+		return nil, err
+	}
+	return rootNode, nil
+}
+
+// resolveAll replaces all the hashed nodes in the subtree with the
+// nodes found in byPath. path is the path to n.
+func (n *InternalNode) resolveAll(path []byte, byPath map[string][]byte) error {
+	for i, child := range n.children {
+		if _, ok := child.(HashedNode); !ok {
+			continue
+		}
+		childPath := append(path[:len(path):len(path)], byte(i))
+		serialized, ok := byPath[string(childPath)]
+		if !ok {
+			return fmt.Errorf("node at path %x is missing from the flushed nodes", childPath)
+		}
+		resolved, err := ParseNode(serialized, n.depth+1)
+		if err != nil {
+			return fmt.Errorf("parsing node at path %x: %w", childPath, err)
+		}
+		n.children[i] = resolved
+		if internal, ok := resolved.(*InternalNode); ok {
+			if err := internal.resolveAll(childPath, byPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (n *InternalNode) collectNonHashedNodes(list []VerkleNode, paths [][]byte, path []byte) ([]VerkleNode, [][]byte) {
 	list = append(list, n)
 	paths = append(paths, path)
@@ -1743,7 +2634,7 @@ func (n *InternalNode) serializeInternalWithUncompressedCommitment(pointsIdx map
 	return serialized, nil
 }
 
-func (n *LeafNode) serializeLeafWithUncompressedCommitments(cBytes, c1Bytes, c2Bytes [banderwagon.UncompressedSize]byte) []byte {
+func (n *LeafNode) serializeLeafWithUncompressedCommitments(cBytes, c1Bytes, c2Bytes [banderwagon.UncompressedSize]byte) ([]byte, error) {
 	// Empty value in LeafNode used for padding.
 	var emptyValue [LeafValueSize]byte
 
@@ -1752,6 +2643,9 @@ func (n *LeafNode) serializeLeafWithUncompressedCommitments(cBytes, c1Bytes, c2B
 	var bitlist [bitlistSize]byte
 	for i, v := range n.values {
 		if v != nil {
+			if len(v) > LeafValueSize {
+				return nil, fmt.Errorf("value at suffix %d is too long: %d > %d", i, len(v), LeafValueSize)
+			}
 			setBit(bitlist[:], i)
 			children = append(children, v...)
 			if padding := emptyValue[:LeafValueSize-len(v)]; len(padding) != 0 {
@@ -1770,5 +2664,5 @@ func (n *LeafNode) serializeLeafWithUncompressedCommitments(cBytes, c1Bytes, c2B
 	copy(result[leafC2CommitmentOffset:], c2Bytes[:])
 	copy(result[leafChildrenOffset:], children)
 
-	return result
+	return result, nil
 }
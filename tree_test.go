@@ -27,6 +27,7 @@ package verkle
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
@@ -36,6 +37,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -168,6 +170,79 @@ func TestOffset2key8BitsWide(t *testing.T) {
 	}
 }
 
+func TestOffset2keyBoundaryKeys(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		key      []byte
+		expected byte
+	}{
+		{zeroKeyTest, 0},
+		{ffx32KeyTest, 0xff},
+	} {
+		for i := byte(0); i < 32; i++ {
+			if childId := offset2key(tc.key, i); childId != tc.expected {
+				t.Fatalf("invalid child number for key %x at offset %d: %d != %d", tc.key, i, childId, tc.expected)
+			}
+		}
+	}
+}
+
+func TestInsertGetBoundaryKeys(t *testing.T) {
+	t.Parallel()
+
+	// Each boundary key gets a sibling whose stem only differs in the
+	// last byte, so that they end up under a stack of 30 internal nodes
+	// along the leftmost and rightmost paths of the tree.
+	zeroSibling := append([]byte{}, zeroKeyTest...)
+	zeroSibling[StemSize-1] = 1
+	ffSibling := append([]byte{}, ffx32KeyTest...)
+	ffSibling[StemSize-1] = 0xfe
+
+	root := New().(*InternalNode)
+	keys := [][]byte{zeroKeyTest, zeroSibling, ffx32KeyTest, ffSibling}
+	for i, key := range keys {
+		if err := root.Insert(key, []byte{byte(i + 1)}, nil); err != nil {
+			t.Fatalf("inserting %x: %v", key, err)
+		}
+	}
+	for i, key := range keys {
+		value, err := root.Get(key, nil)
+		if err != nil {
+			t.Fatalf("reading %x: %v", key, err)
+		}
+		if !bytes.Equal(value, []byte{byte(i + 1)}) {
+			t.Fatalf("invalid value for key %x: %x", key, value)
+		}
+		depth, found, err := root.KeyDepth(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || depth != 8*StemSize {
+			t.Fatalf("key %x should be in a leaf at depth %d, got %d (found=%v)", key, 8*StemSize, depth, found)
+		}
+	}
+
+	// The other keys in the boundary stems are absent.
+	for _, key := range [][]byte{oneKeyTest, append(ffx32KeyTest[:StemSize:StemSize], 0)} {
+		value, err := root.Get(key, nil)
+		if err != nil || value != nil {
+			t.Fatalf("expected no value for key %x, got %x, %v", key, value, err)
+		}
+	}
+
+	// The commitment must not depend on the insertion order.
+	other := New().(*InternalNode)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := other.Insert(keys[i], []byte{byte(i + 1)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !root.Commit().Equal(other.Commit()) {
+		t.Fatal("the commitment depends on the insertion order")
+	}
+}
+
 func TestFlush1kLeaves(t *testing.T) {
 	t.Parallel()
 
@@ -751,6 +826,10 @@ func TestNodeSerde(t *testing.T) {
 	if resRoot.Commitment().BytesUncompressed() != origComm {
 		t.Fatal("invalid deserialized commitment")
 	}
+
+	if err := assertRoundTripRoot(root); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func isInternalEqual(a, b *InternalNode) bool {
@@ -968,6 +1047,30 @@ func TestToDot(t *testing.T) {
 	}
 }
 
+func TestToDotHashByteOrder(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(oneKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	dot := ToDot(root)
+
+	// Internal and leaf nodes must print their hash in the same,
+	// little-endian, byte order.
+	leafHash := root.(*InternalNode).children[0].Hash().BytesLE()
+	rootHash := root.Hash().BytesLE()
+	if !strings.Contains(dot, fmt.Sprintf("L: %x", leafHash)) {
+		t.Fatalf("leaf hash is not little-endian in %s", dot)
+	}
+	if !strings.Contains(dot, fmt.Sprintf("I: %x", rootHash)) {
+		t.Fatalf("internal node hash is not little-endian in %s", dot)
+	}
+}
+
 func TestEmptyCommitment(t *testing.T) {
 	t.Parallel()
 
@@ -1649,3 +1752,1487 @@ func TestLeafNodeInsert(t *testing.T) {
 		t.Fatalf("hash should not be nil")
 	}
 }
+
+func TestPendingChildren(t *testing.T) {
+	t.Parallel()
+
+	key1, _ := hex.DecodeString("0105000000000000000000000000000000000000000000000000000000000000")
+	key2, _ := hex.DecodeString("0107000000000000000000000000000000000000000000000000000000000000")
+	key3, _ := hex.DecodeString("0405000000000000000000000000000000000000000000000000000000000000")
+	root := New().(*InternalNode)
+	if root.HasPendingCommit() || len(root.PendingChildren()) != 0 {
+		t.Fatal("a new tree should not have pending children")
+	}
+
+	if err := root.Insert(key3, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(key1, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.HasPendingCommit() {
+		t.Fatal("root should have a pending commit")
+	}
+	if pending := root.PendingChildren(); !bytes.Equal(pending, []byte{1, 4}) {
+		t.Fatalf("invalid pending children %v", pending)
+	}
+	root.Commit()
+	if root.HasPendingCommit() || len(root.PendingChildren()) != 0 {
+		t.Fatal("commit should clear the pending children")
+	}
+
+	// Splitting the leaf at index 1 creates an internal node, whose
+	// pending children are the two leaves.
+	if err := root.Insert(key2, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pending := root.PendingChildren(); !bytes.Equal(pending, []byte{1}) {
+		t.Fatalf("invalid pending children %v", pending)
+	}
+	if pending := root.children[1].(*InternalNode).PendingChildren(); !bytes.Equal(pending, []byte{5, 7}) {
+		t.Fatalf("invalid pending children %v", pending)
+	}
+}
+
+func TestSubtreeCommitment(t *testing.T) {
+	t.Parallel()
+
+	key1, _ := hex.DecodeString("0105000000000000000000000000000000000000000000000000000000000000")
+	key2, _ := hex.DecodeString("0107000000000000000000000000000000000000000000000000000000000000")
+	key3, _ := hex.DecodeString("0405000000000000000000000000000000000000000000000000000000000000")
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{key1, key2, key3} {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Build the subtree at path 01 on its own and compare.
+	subtree := newInternalNode(1).(*InternalNode)
+	for _, key := range [][]byte{key1, key2} {
+		if err := subtree.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comm, err := root.SubtreeCommitment([]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comm.Equal(subtree.Commit()) {
+		t.Fatal("invalid subtree commitment")
+	}
+
+	// Committing a subtree must not prevent the root from being
+	// committed correctly.
+	other := New()
+	for _, key := range [][]byte{key1, key2, key3} {
+		if err := other.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !root.Commit().Equal(other.Commit()) {
+		t.Fatal("invalid root commitment after committing a subtree")
+	}
+
+	comm, err = root.SubtreeCommitment(nil)
+	if err != nil || !comm.Equal(root.Commitment()) {
+		t.Fatalf("empty path should return the root commitment, err=%v", err)
+	}
+	comm, err = root.SubtreeCommitment([]byte{2})
+	if err != nil || !comm.Equal(Empty{}.Commitment()) {
+		t.Fatalf("empty subtree should have an identity commitment, err=%v", err)
+	}
+	if _, err := root.SubtreeCommitment([]byte{4}); err == nil {
+		t.Fatal("expected an error when the path leads to a leaf")
+	}
+	if _, err := root.SubtreeCommitment([]byte{2, 0}); err == nil {
+		t.Fatal("expected an error when the path goes through an empty node")
+	}
+	root.children[1] = HashedNode{}
+	if _, err := root.SubtreeCommitment([]byte{1, 5}); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected an error when the path goes through a hashed node, got %v", err)
+	}
+}
+
+// BenchmarkSerializeSparseInternalNodes measures the serialization of
+// internal nodes that only have one or two children, which is the
+// common case in the lower levels of the tree.
+func BenchmarkSerializeSparseInternalNodes(b *testing.B) {
+	root := New().(*InternalNode)
+	for i := 0; i < 16; i++ {
+		// Pairs of keys that only differ in their last stem byte, so
+		// that each pair creates a chain of single-child nodes that
+		// ends with a node holding two leaves.
+		for _, last := range []byte{1, 2} {
+			key := make([]byte, StemSize+1)
+			key[0] = byte(i)
+			key[StemSize-1] = last
+			if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	root.Commit()
+
+	var nodes []*InternalNode
+	var collect func(*InternalNode)
+	collect = func(n *InternalNode) {
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if in, ok := c.(*InternalNode); ok {
+				collect(in)
+			}
+		}
+	}
+	collect(root)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for _, n := range nodes {
+			if _, err := n.Serialize(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestMissingNodeInStatelessErrorContext(t *testing.T) {
+	t.Parallel()
+
+	root := NewStatelessInternal(0, new(Point).SetIdentity()).(*InternalNode)
+	root.children[0] = UnknownNode{}
+
+	_, err := root.Get(zeroKeyTest, nil)
+	if !errors.Is(err, errMissingNodeInStateless) {
+		t.Fatalf("expected %v, got %v", errMissingNodeInStateless, err)
+	}
+	if !strings.Contains(err.Error(), "reading stem at depth 1") {
+		t.Fatalf("missing context in error: %v", err)
+	}
+	err = root.Insert(zeroKeyTest, testValue, nil)
+	if !errors.Is(err, errMissingNodeInStateless) {
+		t.Fatalf("expected %v, got %v", errMissingNodeInStateless, err)
+	}
+	if !strings.Contains(err.Error(), "InsertValuesAtStem at depth 1") {
+		t.Fatalf("missing context in error: %v", err)
+	}
+}
+
+func FuzzTreeRoundTrip(f *testing.F) {
+	// Keys that share long prefixes, to exercise leaf splits at every
+	// depth, as well as keys that only differ in their suffix.
+	var seed []byte
+	for i := 0; i < 4; i++ {
+		key := append([]byte{}, ffx32KeyTest...)
+		key[StemSize-1-i] = 0
+		seed = append(append(seed, key...), testValue...)
+	}
+	f.Add(seed)
+	f.Add(append(append(append(append([]byte{}, zeroKeyTest...), testValue...), oneKeyTest...), fourtyKeyTest...))
+	f.Add(append(append(append(append([]byte{}, zeroKeyTest...), testValue...), forkOneKeyTest...), fourtyKeyTest...))
+
+	const entrySize = StemSize + 1 + LeafValueSize
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < entrySize || len(data) > 64*entrySize {
+			return
+		}
+		kvs := map[string][]byte{}
+		var keys [][]byte
+		root := New()
+		for ; len(data) >= entrySize; data = data[entrySize:] {
+			key, value := data[:StemSize+1], data[StemSize+1:entrySize]
+			if _, ok := kvs[string(key)]; !ok {
+				keys = append(keys, key)
+			}
+			kvs[string(key)] = value
+			if err := root.Insert(key, value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range keys {
+			value, err := root.Get(key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, kvs[string(key)]) {
+				t.Fatalf("invalid value for key %x: %x != %x", key, value, kvs[string(key)])
+			}
+		}
+
+		// The root commitment must not depend on the insertion order,
+		// nor change when it is computed again.
+		comm := root.Commit()
+		if !comm.Equal(root.Commit()) {
+			t.Fatal("root commitment changed when recomputed")
+		}
+		other := New()
+		for i := len(keys) - 1; i >= 0; i-- {
+			if err := other.Insert(keys[i], kvs[string(keys[i])], nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !comm.Equal(other.Commit()) {
+			t.Fatal("root commitment depends on the insertion order")
+		}
+
+		// Serialize the tree, load it back and check that both the
+		// root commitment and the values are preserved.
+		db := map[string][]byte{}
+		root.(*InternalNode).Flush(func(path []byte, node VerkleNode) {
+			serialized, err := node.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			db[string(path)] = serialized
+		})
+		resolver := func(path []byte) ([]byte, error) {
+			return db[string(path)], nil
+		}
+		loaded, err := ParseNode(db[""], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loaded.Commitment().Equal(comm) {
+			t.Fatal("root commitment changed after a serialization round-trip")
+		}
+		for _, key := range keys {
+			value, err := loaded.Get(key, resolver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, kvs[string(key)]) {
+				t.Fatalf("invalid value for key %x after a round-trip: %x != %x", key, value, kvs[string(key)])
+			}
+		}
+		if !loaded.Commit().Equal(comm) {
+			t.Fatal("root commitment changed after resolving the tree")
+		}
+	})
+}
+
+func TestFreeze(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	if !root.IsFrozen() || root.HasPendingCommit() {
+		t.Fatal("tree should be frozen and committed")
+	}
+	expected := root.Commitment().Bytes()
+
+	// Readers run concurrently, this is meant to be checked with the
+	// race detector.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, key := range keys {
+				value, err := root.Get(key, nil)
+				if err != nil || !bytes.Equal(value, fourtyKeyTest) {
+					t.Errorf("invalid value for key %x: %x, %v", key, value, err)
+					return
+				}
+				root.Hash()
+				for _, child := range root.children {
+					if leaf, ok := child.(*LeafNode); ok {
+						leaf.Hash()
+					}
+				}
+				if root.Commit().Bytes() != expected {
+					t.Error("commitment of a frozen tree changed")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+	if _, err := root.Delete(keys[0], nil); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+	if err := root.SetChild(0, Empty{}); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+	flush := func([]byte, VerkleNode) { t.Fatal("a frozen tree was flushed") }
+	if err := root.TryFlush(flush); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+	if err := root.TryFlushAtDepth(0, flush); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+
+	// Subtrees are frozen as well.
+	for _, child := range root.children {
+		switch child := child.(type) {
+		case *InternalNode:
+			if err := child.Insert(keys[0], testValue, nil); err != ErrFrozen {
+				t.Fatalf("expected %v, got %v", ErrFrozen, err)
+			}
+			if err := child.TryFlush(flush); err != ErrFrozen {
+				t.Fatalf("expected %v, got %v", ErrFrozen, err)
+			}
+		case *LeafNode:
+			key := append(append([]byte{}, child.stem...), 0)
+			if err := child.SetValue(key, testValue); err != ErrFrozen {
+				t.Fatalf("expected %v, got %v", ErrFrozen, err)
+			}
+			if err := child.Insert(key, testValue, nil); err != ErrFrozen {
+				t.Fatalf("expected %v, got %v", ErrFrozen, err)
+			}
+			if _, err := child.Delete(key, nil); err != ErrFrozen {
+				t.Fatalf("expected %v, got %v", ErrFrozen, err)
+			}
+		}
+	}
+	if root.Commit().Bytes() != expected {
+		t.Fatal("commitment of a frozen tree changed")
+	}
+	if _, err := root.SimulateInsert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatalf("could not simulate an insertion in a frozen tree: %v", err)
+	}
+
+	// A copy can be modified.
+	cpy := root.Copy().(*InternalNode)
+	if err := cpy.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A subtree frozen on its own prevents the whole tree from being
+	// flushed, and the check is made before anything is flushed.
+	var frozenChild *InternalNode
+	for _, child := range cpy.children {
+		if c, ok := child.(*InternalNode); ok {
+			frozenChild = c
+			break
+		}
+	}
+	if frozenChild == nil {
+		t.Fatal("expected an internal node below the root")
+	}
+	if err := frozenChild.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpy.TryFlush(flush); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+	if err := cpy.TryFlushAtDepth(0, flush); err != ErrFrozen {
+		t.Fatalf("expected %v, got %v", ErrFrozen, err)
+	}
+	for i, child := range cpy.children {
+		if _, ok := child.(HashedNode); ok {
+			t.Fatalf("child %d was flushed", i)
+		}
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrFrozen {
+				t.Fatalf("expected a panic with %v, got %v", ErrFrozen, r)
+			}
+		}()
+		cpy.Flush(flush)
+	}()
+
+	// Trees with nodes that need resolving can't be frozen.
+	cpy = root.Copy().(*InternalNode)
+	cpy.Commit()
+	cpy.children[zeroKeyTest[0]] = HashedNode{}
+	if err := cpy.Freeze(); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+}
+
+func TestRebuildFromFlush(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 200)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comm := root.Commit().Bytes()
+
+	// Rebuild from the stream of nodes produced by BatchSerialize.
+	serialized, err := root.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := RebuildFromFlush(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isInternalEqual(root, rebuilt) {
+		t.Fatal("tree rebuilt from BatchSerialize is different from the original")
+	}
+	if err := assertRoundTripRoot(rebuilt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild from the stream of nodes produced by Flush.
+	var flushed []SerializedNode
+	root.Flush(func(path []byte, node VerkleNode) {
+		flushed = append(flushed, SerializedNode{Node: node, Path: append([]byte{}, path...)})
+	})
+	rebuilt, err = RebuildFromFlush(flushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.Commit().Bytes() != comm {
+		t.Fatal("invalid root commitment after rebuilding from Flush")
+	}
+	for _, key := range keys {
+		value, err := rebuilt.Get(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, fourtyKeyTest) {
+			t.Fatalf("invalid value for key %x: %x", key, value)
+		}
+	}
+
+	// Remove a node from the stream.
+	for i, node := range flushed {
+		if len(node.Path) == 1 {
+			flushed = append(flushed[:i], flushed[i+1:]...)
+			break
+		}
+	}
+	if _, err := RebuildFromFlush(flushed); err == nil {
+		t.Fatal("expected an error when a node is missing from the stream")
+	}
+	if _, err := RebuildFromFlush(nil); err == nil {
+		t.Fatal("expected an error when the root is missing from the stream")
+	}
+}
+
+func TestGetWithLeafCommitment(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	low := append(append([]byte{}, ffx32KeyTest[:StemSize]...), 5)
+	high := append(append([]byte{}, ffx32KeyTest[:StemSize]...), 200)
+	if err := root.Insert(low, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(high, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	leaf := root.children[0xff].(*LeafNode)
+
+	value, comm, err := root.GetWithLeafCommitment(low, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, testValue) || comm != leaf.c1 {
+		t.Fatalf("invalid value or commitment for the low key: %x", value)
+	}
+	value, comm, err = root.GetWithLeafCommitment(high, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, fourtyKeyTest) || comm != leaf.c2 {
+		t.Fatalf("invalid value or commitment for the high key: %x", value)
+	}
+
+	// The commitment is returned even if the value itself is missing.
+	missing := append(append([]byte{}, ffx32KeyTest[:StemSize]...), 6)
+	value, comm, err = root.GetWithLeafCommitment(missing, nil)
+	if err != nil || value != nil || comm != leaf.c1 {
+		t.Fatalf("invalid result for a missing suffix: %x, %v", value, err)
+	}
+	value, comm, err = root.GetWithLeafCommitment(zeroKeyTest, nil)
+	if err != nil || value != nil || comm != nil {
+		t.Fatalf("invalid result for a missing stem: %x, %v", value, err)
+	}
+
+	leaf.isPOAStub = true
+	if _, _, err := root.GetWithLeafCommitment(low, nil); err != errIsPOAStub {
+		t.Fatalf("expected %v, got %v", errIsPOAStub, err)
+	}
+}
+
+func TestLeafWritesAcrossBothSuffixTrees(t *testing.T) {
+	t.Parallel()
+
+	stem := ffx32KeyTest[:StemSize]
+	key := func(suffix byte) []byte {
+		return append(append([]byte{}, stem...), suffix)
+	}
+	expected := func(suffixes ...byte) *Point {
+		values := make([][]byte, NodeWidth)
+		for _, suffix := range suffixes {
+			values[suffix] = testValue
+		}
+		leaf, err := NewLeafNode(stem, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Commitment()
+	}
+
+	// Write both halves of a brand new leaf at once.
+	values := make([][]byte, NodeWidth)
+	values[5], values[200] = testValue, testValue
+	leaf, err := NewLeafNode(stem, make([][]byte, NodeWidth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.updateMultipleLeaves(values); err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.Commitment().Equal(expected(5, 200)) {
+		t.Fatal("invalid commitment after writing to both suffix trees")
+	}
+
+	// Empty C1 through a deletion, then write to it again.
+	root := New()
+	if err := root.Insert(key(5), testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(key(200), testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Delete(key(5), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(rootWithLeaf(t, expected(200))) {
+		t.Fatal("invalid root commitment after emptying C1")
+	}
+	if _, err := root.(*InternalNode).children[0xff].Serialize(); err != nil {
+		t.Fatalf("serializing a leaf with an empty C1: %v", err)
+	}
+	if err := root.Insert(key(6), testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(rootWithLeaf(t, expected(6, 200))) {
+		t.Fatal("invalid root commitment after writing to an emptied C1")
+	}
+}
+
+// rootWithLeaf returns the commitment of a root node whose only child is
+// a leaf at index 0xff with commitment comm.
+func rootWithLeaf(t *testing.T, comm *Point) *Point {
+	t.Helper()
+
+	var poly [NodeWidth]Fr
+	comm.MapToScalarField(&poly[0xff])
+	return GetConfig().CommitToPoly(poly[:], 0)
+}
+
+func TestPopulatedChildren(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if populated := root.PopulatedChildren(); len(populated) != 0 {
+		t.Fatalf("empty node should have no populated children, got %v", populated)
+	}
+	for _, key := range [][]byte{ffx32KeyTest, fourtyKeyTest, zeroKeyTest, oneKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	root.children[0x40] = HashedNode{}
+
+	populated := root.PopulatedChildren()
+	if len(populated) != 3 || populated[0] != 0 || populated[1] != 0x40 || populated[2] != 0xff {
+		t.Fatalf("invalid populated children %v", populated)
+	}
+
+	// The result must match the bitlist of the serialized node.
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitlist := serialized[internalBitlistOffset:internalCommitmentOffset]
+	var fromBitlist []int
+	for i := 0; i < NodeWidth; i++ {
+		if bit(bitlist, i) {
+			fromBitlist = append(fromBitlist, i)
+		}
+	}
+	if fmt.Sprint(fromBitlist) != fmt.Sprint(populated) {
+		t.Fatalf("populated children %v don't match the bitlist %v", populated, fromBitlist)
+	}
+}
+
+func TestLeafSetValue(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[1] = testValue
+	leaf, err := NewLeafNode(zeroKeyTest[:StemSize], values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm := leaf.Commitment().Bytes()
+
+	// Rebuild the leaf from its commitments and values, as it would be
+	// from a witness.
+	rebuilt := &LeafNode{
+		stem:       leaf.stem,
+		values:     make([][]byte, NodeWidth),
+		commitment: leaf.commitment,
+		c1:         leaf.c1,
+		c2:         leaf.c2,
+	}
+	if err := rebuilt.SetValue(oneKeyTest, testValue); err != nil {
+		t.Fatal(err)
+	}
+	if !isLeafEqual(leaf, rebuilt) || rebuilt.Commitment().Bytes() != comm {
+		t.Fatal("rebuilt leaf is different from the original")
+	}
+
+	if err := rebuilt.SetValue(ffx32KeyTest, testValue); !errors.Is(err, errInsertIntoOtherStem) {
+		t.Fatalf("expected %v, got %v", errInsertIntoOtherStem, err)
+	}
+	if err := rebuilt.SetValue(oneKeyTest[:StemSize], testValue); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+	if err := rebuilt.SetValue(oneKeyTest, make([]byte, LeafValueSize+1)); err == nil {
+		t.Fatal("expected an error for a value that is too long")
+	}
+	rebuilt.isPOAStub = true
+	if err := rebuilt.SetValue(oneKeyTest, testValue); err != errIsPOAStub {
+		t.Fatalf("expected %v, got %v", errIsPOAStub, err)
+	}
+}
+
+func TestGetDetailed(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	value, stored, err := root.GetDetailed(zeroKeyTest, nil)
+	if err != nil || !bytes.Equal(value, testValue) || stored != nil {
+		t.Fatalf("invalid result for a present key: %x, %x, %v", value, stored, err)
+	}
+	value, stored, err = root.GetDetailed(oneKeyTest, nil)
+	if err != nil || value != nil || stored != nil {
+		t.Fatalf("invalid result for a missing suffix: %x, %x, %v", value, stored, err)
+	}
+
+	// Same path, different stem.
+	value, stored, err = root.GetDetailed(forkOneKeyTest, nil)
+	if err != nil || value != nil || !bytes.Equal(stored, zeroKeyTest[:StemSize]) {
+		t.Fatalf("invalid result for a different stem: %x, %x, %v", value, stored, err)
+	}
+
+	// Empty path.
+	value, stored, err = root.GetDetailed(ffx32KeyTest, nil)
+	if err != nil || value != nil || stored != nil {
+		t.Fatalf("invalid result for an empty path: %x, %x, %v", value, stored, err)
+	}
+}
+
+// countdownCtx is a context that gets cancelled after its Err method
+// has been called a given number of times.
+type countdownCtx struct {
+	context.Context
+	remaining int
+}
+
+func (c *countdownCtx) Err() error {
+	if c.remaining == 0 {
+		return context.Canceled
+	}
+	c.remaining--
+	return nil
+}
+
+func TestCommitCtxCancellation(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 1000)
+	build := func() *InternalNode {
+		root := New().(*InternalNode)
+		for _, key := range keys {
+			if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+	expected := build().Commit()
+
+	// A cancelled context prevents any work.
+	root := build()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := root.CommitCtx(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if !root.HasPendingCommit() {
+		t.Fatal("root should still have pending changes")
+	}
+
+	// Cancel after the deepest level has been committed, then resume.
+	if _, err := root.CommitCtx(&countdownCtx{Context: context.Background(), remaining: 1}); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	comm, err := root.CommitCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comm.Equal(expected) {
+		t.Fatal("invalid root commitment after resuming a cancelled commit")
+	}
+}
+
+func TestFlushOrderIsDeterministic(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 200)
+	flushPaths := func(reverse bool) [][]byte {
+		root := New()
+		for i := range keys {
+			key := keys[i]
+			if reverse {
+				key = keys[len(keys)-1-i]
+			}
+			if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root.Commit()
+
+		// Flush a tree rebuilt from a proof, so that it also covers
+		// trees that are only partially resolved.
+		proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys[:50], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pre, err := PreStateTreeFromProof(proof, root.Commit())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths [][]byte
+		for _, tree := range []VerkleNode{root, pre} {
+			tree.(*InternalNode).Flush(func(path []byte, _ VerkleNode) {
+				paths = append(paths, append([]byte{}, path...))
+			})
+		}
+		return paths
+	}
+
+	first, second := flushPaths(false), flushPaths(true)
+	if len(first) != len(second) {
+		t.Fatalf("different number of flushed nodes: %d != %d", len(first), len(second))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Fatalf("flush order differs at node %d: %x != %x", i, first[i], second[i])
+		}
+	}
+}
+
+func TestKeyDepth(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		key   []byte
+		depth int
+		found bool
+	}{
+		{zeroKeyTest, 16, true},    // shares its first byte with forkOneKeyTest
+		{forkOneKeyTest, 16, true}, // same
+		{ffx32KeyTest, 8, true},    // alone under 0xff
+		{oneKeyTest, 16, false},    // same stem as zeroKeyTest, missing suffix
+		{fourtyKeyTest, 8, false},  // empty slot under the root
+	} {
+		depth, found, err := root.KeyDepth(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth != tc.depth || found != tc.found {
+			t.Fatalf("key %x: expected (%d, %v), got (%d, %v)", tc.key, tc.depth, tc.found, depth, found)
+		}
+	}
+
+	root.Commit()
+	root.children[0xff] = HashedNode{}
+	if _, _, err := root.KeyDepth(ffx32KeyTest); !errors.Is(err, errReadFromInvalid) {
+		t.Fatalf("expected %v, got %v", errReadFromInvalid, err)
+	}
+	if _, _, err := root.KeyDepth(ffx32KeyTest[:StemSize]); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+}
+
+func TestCommitAndHash(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	hash := root.CommitAndHash()
+	if !hash.Equal(root.Hash()) {
+		t.Fatal("CommitAndHash should return the hash of the committed root")
+	}
+
+	if err := root.Insert(ffx32KeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if hash = root.CommitAndHash(); root.HasPendingCommit() || !hash.Equal(root.Hash()) {
+		t.Fatal("CommitAndHash should commit the pending changes")
+	}
+}
+
+func TestInsertValuesAtStemInvalidLength(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.InsertValuesAtStem(zeroKeyTest[:StemSize], make([][]byte, 10), nil); err == nil || !strings.Contains(err.Error(), "invalid number of values") {
+		t.Fatalf("expected an invalid number of values error, got %v", err)
+	}
+	if _, ok := root.children[0].(Empty); !ok {
+		t.Fatal("nothing should have been inserted")
+	}
+
+	// Same thing when the leaf already exists.
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.InsertValuesAtStem(zeroKeyTest[:StemSize], make([][]byte, 10), nil); err == nil || !strings.Contains(err.Error(), "invalid number of values") {
+		t.Fatalf("expected an invalid number of values error, got %v", err)
+	}
+}
+
+func TestHasUnflushed(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if root.HasUnflushed() {
+		t.Fatal("an empty tree should not have unflushed data")
+	}
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !root.HasUnflushed() {
+		t.Fatal("inserted data should be unflushed")
+	}
+	root.Commit()
+	if !root.HasUnflushed() {
+		t.Fatal("committed data should still be unflushed")
+	}
+
+	flushed := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushed[string(path)] = serialized
+	})
+	if root.HasUnflushed() {
+		t.Fatal("a flushed tree should not have unflushed data")
+	}
+
+	resolver := func(path []byte) ([]byte, error) {
+		return flushed[string(path)], nil
+	}
+	if err := root.Insert(fourtyKeyTest, testValue, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if !root.HasUnflushed() {
+		t.Fatal("data inserted after a flush should be unflushed")
+	}
+}
+
+func TestCommitAllZeroChildren(t *testing.T) {
+	t.Parallel()
+
+	// Committing to the zero polynomial yields the identity, whether
+	// or not the caller hints that all the entries are zero.
+	var poly [NodeWidth]Fr
+	cfg := GetConfig()
+	for _, emptyChildren := range []int{0, NodeWidth} {
+		if !cfg.CommitToPoly(poly[:], emptyChildren).Equal(new(Point).SetIdentity()) {
+			t.Fatalf("zero polynomial should commit to the identity, with %d empty children", emptyChildren)
+		}
+	}
+
+	// Empty internal nodes have the identity as their commitment, and
+	// thus hash to zero: a node whose children are all such nodes is
+	// not empty, yet commits to the zero polynomial.
+	root := New().(*InternalNode)
+	for _, idx := range []byte{0, 5, 0xff} {
+		root.cowChild(idx)
+		root.children[idx] = newInternalNode(1)
+	}
+	if !root.Commit().Equal(new(Point).SetIdentity()) {
+		t.Fatal("root commitment should be the identity")
+	}
+	if !root.Hash().IsZero() {
+		t.Fatal("root hash should be zero")
+	}
+}
+
+func TestDeleteRemovesEmptiedInternalNodes(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// The internal node holding both leaves is kept as long as one of
+	// them is left, and removed along with the last one.
+	if _, err := root.Delete(forkOneKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root.children[0].(*InternalNode); !ok {
+		t.Fatalf("expected an internal node at index 0, got %T", root.children[0])
+	}
+	if _, err := root.Delete(zeroKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root.children[0].(Empty); !ok {
+		t.Fatalf("expected an empty node at index 0, got %T", root.children[0])
+	}
+	if !root.Commit().Equal(New().Commit()) {
+		t.Fatal("deleting every key should give the commitment of the empty tree")
+	}
+}
+
+func TestDeleteKeepsSiblings(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := root.Delete(forkOneKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	value, err := root.Get(zeroKeyTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, testValue) {
+		t.Fatalf("deleting a leaf removed its sibling: got %x", value)
+	}
+}
+
+func TestDeletionFootprint(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Checks the footprint of key, then that deleting key removes
+	// exactly those nodes.
+	check := func(key []byte, expected ...[]byte) {
+		t.Helper()
+
+		removed, err := root.DeletionFootprint(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != len(expected) {
+			t.Fatalf("key %x: expected %x, got %x", key, expected, removed)
+		}
+		for i := range expected {
+			if !bytes.Equal(removed[i], expected[i]) {
+				t.Fatalf("key %x: expected %x, got %x", key, expected, removed)
+			}
+		}
+
+		if _, err := root.Delete(key, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range removed {
+			parent := root
+			for _, idx := range path[:len(path)-1] {
+				next, ok := parent.children[idx].(*InternalNode)
+				if !ok {
+					break
+				}
+				parent = next
+			}
+			if _, ok := parent.children[path[parent.depth]].(Empty); !ok {
+				t.Fatalf("key %x: node at path %x should have been removed", key, path)
+			}
+		}
+	}
+
+	check(fourtyKeyTest)                // absent
+	check(oneKeyTest)                   // the leaf keeps zeroKeyTest
+	check(forkOneKeyTest, []byte{0, 1}) // the internal node keeps zeroKeyTest
+	check(zeroKeyTest, []byte{0, 0}, []byte{0})
+
+	// Hashed nodes are resolved, but the tree isn't modified.
+	root.Commit()
+	flushed := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushed[string(path)] = serialized
+	})
+	if _, err := root.DeletionFootprint(ffx32KeyTest, nil); !errors.Is(err, errDeleteHash) {
+		t.Fatalf("expected %v, got %v", errDeleteHash, err)
+	}
+	removed, err := root.DeletionFootprint(ffx32KeyTest, func(path []byte) ([]byte, error) {
+		return flushed[string(path)], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || !bytes.Equal(removed[0], []byte{0xff}) {
+		t.Fatalf("expected the leaf at path ff, got %x", removed)
+	}
+	if _, ok := root.children[0xff].(HashedNode); !ok {
+		t.Fatal("the tree should not have been modified")
+	}
+}
+
+func TestGetBounded(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		key      []byte
+		maxDepth int
+		value    []byte
+		err      error
+	}{
+		{ffx32KeyTest, 8, testValue, nil},
+		{zeroKeyTest, 16, testValue, nil},
+		{zeroKeyTest, 15, nil, errDepthExceeded},
+		{zeroKeyTest, 0, nil, errDepthExceeded},
+		{oneKeyTest, 16, nil, nil},
+		{fourtyKeyTest, 8, nil, nil},
+	} {
+		value, err := root.GetBounded(tc.key, tc.maxDepth, nil)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("key %x, max depth %d: expected error %v, got %v", tc.key, tc.maxDepth, tc.err, err)
+		}
+		if !bytes.Equal(value, tc.value) {
+			t.Fatalf("key %x, max depth %d: expected %x, got %x", tc.key, tc.maxDepth, tc.value, value)
+		}
+	}
+}
+
+func TestLeafMeta(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	stem := zeroKeyTest[:StemSize]
+	serialized, err := root.children[0].Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.SetLeafMeta(stem, uint64(42), nil); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := root.LeafMeta(stem, nil)
+	if err != nil || meta != uint64(42) {
+		t.Fatalf("expected metadata 42, got %v, %v", meta, err)
+	}
+
+	// The metadata survives a split.
+	if err := root.Insert(forkOneKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ = root.LeafMeta(stem, nil); meta != uint64(42) {
+		t.Fatalf("metadata lost after a split: %v", meta)
+	}
+
+	// It changes neither the commitment nor the serialized form.
+	leaf := root.children[0].(*InternalNode).children[0].(*LeafNode)
+	other, err := leaf.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(other, serialized) {
+		t.Fatal("metadata should not be serialized")
+	}
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	fresh, err := NewLeafNode(stem, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.Commitment().Equal(fresh.Commitment()) {
+		t.Fatal("metadata should not change the commitment")
+	}
+
+	if copied := leaf.Copy().(*LeafNode); copied.Meta() != uint64(42) {
+		t.Fatalf("metadata not copied: %v", copied.Meta())
+	}
+
+	if err := root.SetLeafMeta(ffx32KeyTest[:StemSize], "x", nil); err == nil {
+		t.Fatal("expected an error for a missing stem")
+	}
+	if meta, err = root.LeafMeta(ffx32KeyTest[:StemSize], nil); meta != nil || err != nil {
+		t.Fatalf("expected no metadata, got %v, %v", meta, err)
+	}
+}
+
+func TestSimulateInsert(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root := New().(*InternalNode)
+	for _, key := range append(keys, zeroKeyTest) {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comm := root.Commit().Bytes()
+
+	// Cover a new value in an existing leaf, an update, a leaf split
+	// and a new stem.
+	for _, key := range [][]byte{oneKeyTest, zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		simulated, err := root.SimulateInsert(key, testValue, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Commit().Bytes() != comm {
+			t.Fatalf("simulating an insert at %x modified the tree", key)
+		}
+
+		expected := root.Copy()
+		if err := expected.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !simulated.Equal(expected.Commit()) {
+			t.Fatalf("invalid simulated root commitment for key %x", key)
+		}
+	}
+	if value, err := root.Get(zeroKeyTest, nil); err != nil || !bytes.Equal(value, fourtyKeyTest) {
+		t.Fatalf("the original value was modified: %x, %v", value, err)
+	}
+
+	// Hashed nodes along the path are resolved in the copy only.
+	expected := root.Copy()
+	if err := expected.Insert(keys[0], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	flushed := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushed[string(path)] = serialized
+	})
+	simulated, err := root.SimulateInsert(keys[0], testValue, func(path []byte) ([]byte, error) {
+		return flushed[string(path)], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !simulated.Equal(expected.Commit()) {
+		t.Fatal("invalid simulated root commitment with hashed nodes")
+	}
+	if _, ok := root.children[keys[0][0]].(HashedNode); !ok {
+		t.Fatal("the hashed node should not have been resolved in the original tree")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 200)
+	root := New().(*InternalNode)
+	for _, key := range keys[:100] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Interleave present and absent keys, with a duplicate.
+	var query, expectedPresent, expectedAbsent [][]byte
+	for i := 0; i < 100; i++ {
+		query = append(query, keys[i], keys[100+i])
+		expectedPresent = append(expectedPresent, keys[i])
+		expectedAbsent = append(expectedAbsent, keys[100+i])
+	}
+	query = append(query, keys[0])
+	expectedPresent = append(expectedPresent, keys[0])
+
+	root.Commit()
+	flushed := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushed[string(path)] = serialized
+	})
+	present, absent, err := root.Partition(query, func(path []byte) ([]byte, error) {
+		return flushed[string(path)], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		got, expected [][]byte
+	}{{present, expectedPresent}, {absent, expectedAbsent}} {
+		if len(tc.got) != len(tc.expected) {
+			t.Fatalf("invalid number of keys: %d != %d", len(tc.got), len(tc.expected))
+		}
+		for i := range tc.expected {
+			if !bytes.Equal(tc.got[i], tc.expected[i]) {
+				t.Fatalf("invalid key at position %d: %x != %x", i, tc.got[i], tc.expected[i])
+			}
+		}
+	}
+
+	if _, _, err := root.Partition([][]byte{zeroKeyTest[:StemSize]}, nil); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+}
+
+func TestInsertValueTooLong(t *testing.T) {
+	t.Parallel()
+
+	long := make([]byte, 40)
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, long, nil); err == nil {
+		t.Fatal("expected an error when creating a leaf with a 40-byte value")
+	}
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	comm := root.Commit().Bytes()
+
+	// Updating both suffix trees, with the long value in the second
+	// one, must leave the leaf untouched.
+	values := make([][]byte, NodeWidth)
+	values[1] = fourtyKeyTest
+	values[200] = long
+	if err := root.InsertValuesAtStem(zeroKeyTest[:StemSize], values, nil); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("expected a value too long error, got %v", err)
+	}
+	if err := root.Insert(oneKeyTest, long, nil); err == nil {
+		t.Fatal("expected an error when inserting a 40-byte value")
+	}
+	if err := root.Insert(forkOneKeyTest, long, nil); err == nil {
+		t.Fatal("expected an error when splitting a leaf with a 40-byte value")
+	}
+	if _, ok := root.children[0].(*LeafNode); !ok {
+		t.Fatal("a failed insert split the leaf")
+	}
+	if err := root.children[0].Insert(oneKeyTest, long, nil); err == nil {
+		t.Fatal("expected an error when inserting a 40-byte value in the leaf")
+	}
+	if root.Commit().Bytes() != comm {
+		t.Fatal("a failed insert modified the root commitment")
+	}
+	if value, _ := root.Get(oneKeyTest, nil); value != nil {
+		t.Fatalf("a failed insert modified the values: %x", value)
+	}
+
+	// Leaves built without checks can't be serialized.
+	leaf := root.children[0].(*LeafNode)
+	leaf.values[2] = long
+	if _, err := leaf.Serialize(); err == nil {
+		t.Fatal("expected an error when serializing a 40-byte value")
+	}
+	if _, err := root.BatchSerialize(); err == nil {
+		t.Fatal("expected an error when serializing a 40-byte value")
+	}
+}
+
+func TestResolutionPath(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if paths := root.ResolutionPath(zeroKeyTest); paths != nil {
+		t.Fatalf("an in-memory tree should need no resolution, got %x", paths)
+	}
+
+	root.Commit()
+	flushed := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushed[string(path)] = serialized
+	})
+
+	// Resolve the path of zeroKeyTest one node at a time, checking
+	// that the read only asks for the paths that were announced.
+	var requested [][]byte
+	resolver := func(path []byte) ([]byte, error) {
+		requested = append(requested, path)
+		return flushed[string(path)], nil
+	}
+	var announced [][]byte
+	for {
+		paths := root.ResolutionPath(zeroKeyTest)
+		if paths == nil {
+			break
+		}
+		announced = append(announced, paths...)
+		node := root
+		for len(paths[0]) > int(node.depth)+1 {
+			node = node.children[paths[0][node.depth]].(*InternalNode)
+		}
+		if err := node.resolveChild(zeroKeyTest, resolver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(announced) != 2 || !bytes.Equal(announced[0], []byte{0}) || !bytes.Equal(announced[1], []byte{0, 0}) {
+		t.Fatalf("invalid resolution paths %x", announced)
+	}
+	requested = nil
+	if value, err := root.Get(zeroKeyTest, resolver); err != nil || !bytes.Equal(value, testValue) {
+		t.Fatalf("invalid value %x, %v", value, err)
+	}
+	if len(requested) != 0 {
+		t.Fatalf("the read should not have needed the resolver, requested %x", requested)
+	}
+}
+
+func TestLeafHashCache(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	leaf := root.children[0].(*LeafNode)
+	checkHash := func() {
+		t.Helper()
+		var expected Fr
+		leaf.Commitment().MapToScalarField(&expected)
+		if !leaf.Hash().Equal(&expected) {
+			t.Fatal("invalid leaf hash")
+		}
+	}
+
+	// Hash doesn't modify the leaf, the cache is filled by Commit.
+	checkHash()
+	if leaf.hashValid {
+		t.Fatal("Hash should not fill the cache")
+	}
+	root.Commit()
+	if !leaf.hashValid {
+		t.Fatal("the hash should be cached after Commit")
+	}
+	checkHash()
+
+	// Once cached, the hash is not recomputed from the commitment.
+	leaf.hash.SetOne()
+	if !leaf.Hash().Equal(&FrOne) {
+		t.Fatal("the hash was recomputed")
+	}
+	leaf.hashValid = false
+	root.cowChild(0)
+	root.Commit()
+	checkHash()
+
+	// Modifying the returned hash doesn't alter the cached one.
+	leaf.Hash().SetOne()
+	checkHash()
+
+	// Every update of the commitment invalidates the cached hash.
+	for _, update := range []func() error{
+		func() error { return root.Insert(oneKeyTest, testValue, nil) },
+		func() error {
+			values := make([][]byte, NodeWidth)
+			values[200] = testValue
+			return root.InsertValuesAtStem(zeroKeyTest[:StemSize], values, nil)
+		},
+		func() error {
+			_, err := root.Delete(oneKeyTest, nil)
+			return err
+		},
+	} {
+		if err := update(); err != nil {
+			t.Fatal(err)
+		}
+		if leaf.hashValid {
+			t.Fatal("the cached hash wasn't invalidated")
+		}
+		checkHash()
+		root.Commit()
+		if !leaf.hashValid {
+			t.Fatal("the hash should be cached after Commit")
+		}
+		checkHash()
+	}
+}
+
+func BenchmarkLeafHash(b *testing.B) {
+	root := New().(*InternalNode)
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		b.Fatal(err)
+	}
+	root.Commit()
+	leaf := root.children[0].(*LeafNode)
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			leaf.Hash()
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		uncached := *leaf
+		uncached.hashValid = false
+		for i := 0; i < b.N; i++ {
+			uncached.Hash()
+		}
+	})
+}
@@ -0,0 +1,244 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	HeaderStorageOffset = 64  // Defined by the spec.
+	CodeOffset          = 128 // Defined by the spec.
+	AddressSize         = 32
+
+	// treeKeyPolyMarker is the first element of the polynomial that
+	// is committed to in order to derive a tree key: 2 + 256 * 64,
+	// where 64 is the length of the (address || tree index) input.
+	treeKeyPolyMarker = 2 + 256*64
+)
+
+// MainStorageOffset is the position of the first storage slot that
+// isn't stored in the account header, i.e. 256**31.
+var MainStorageOffset = new(big.Int).Lsh(big.NewInt(1), 8*StemSize)
+
+var errInvalidAddressSize = errors.New("address is longer than 32 bytes")
+
+// GetTreeKey computes the tree key corresponding to a (tree index,
+// sub index) pair in the storage of a 32-byte address, as defined
+// by the spec: the stem is the Pedersen hash of the address and of
+// the tree index, and the suffix is the sub index.
+func GetTreeKey(address []byte, treeIndex *big.Int, subIndex byte) ([]byte, error) {
+	addr, err := addressToBytes32(address)
+	if err != nil {
+		return nil, err
+	}
+	if treeIndex.Sign() < 0 || treeIndex.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid tree index %s", treeIndex)
+	}
+
+	// The tree index is interpreted as a 32-byte little-endian
+	// integer, and split in two 16-byte halves.
+	var index [32]byte
+	treeIndex.FillBytes(index[:])
+	for i := 0; i < len(index)/2; i++ {
+		index[i], index[len(index)-1-i] = index[len(index)-1-i], index[i]
+	}
+
+	var poly [5]Fr
+	poly[0].SetUint64(treeKeyPolyMarker)
+	if err := FromLEBytes(&poly[1], addr[:16]); err != nil {
+		return nil, err
+	}
+	if err := FromLEBytes(&poly[2], addr[16:]); err != nil {
+		return nil, err
+	}
+	if err := FromLEBytes(&poly[3], index[:16]); err != nil {
+		return nil, err
+	}
+	if err := FromLEBytes(&poly[4], index[16:]); err != nil {
+		return nil, err
+	}
+
+	var hash Fr
+	GetConfig().CommitToPoly(poly[:], 0).MapToScalarField(&hash)
+	key := hash.BytesLE()
+	key[StemSize] = subIndex
+	return key[:], nil
+}
+
+// StorageSlotKey returns the tree key of a storage slot. The first
+// slots are stored in the account header, and all the others are
+// stored in the main storage area.
+func StorageSlotKey(address []byte, slot *big.Int) ([]byte, error) {
+	if slot.Sign() < 0 || slot.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid storage slot %s", slot)
+	}
+
+	pos := new(big.Int)
+	if slot.Cmp(big.NewInt(CodeOffset-HeaderStorageOffset)) < 0 {
+		pos.Add(big.NewInt(HeaderStorageOffset), slot)
+	} else {
+		pos.Add(MainStorageOffset, slot)
+	}
+
+	treeIndex, subIndex := new(big.Int).DivMod(pos, big.NewInt(NodeWidth), new(big.Int))
+	return GetTreeKey(address, treeIndex, byte(subIndex.Uint64()))
+}
+
+// AddressToStem returns the stem of the account header of an address,
+// which holds the account's metadata as well as its first storage slots
+// and code chunks. Both 20-byte and 32-byte addresses are accepted. It
+// panics if the address is longer than 32 bytes.
+func AddressToStem(address []byte) []byte {
+	key, err := GetTreeKey(address, new(big.Int), 0)
+	if err != nil {
+		panic(err)
+	}
+	return key[:StemSize]
+}
+
+// CodeChunkKey returns the tree key of the chunk-th 31-byte code chunk
+// of a contract. It panics if the address is longer than 32 bytes.
+func CodeChunkKey(address []byte, chunk uint64) []byte {
+	// Compute (CodeOffset + chunk) / NodeWidth and (CodeOffset + chunk) % NodeWidth
+	// without overflowing if chunk is close to the max uint64 value.
+	pos := chunk%NodeWidth + CodeOffset
+	treeIndex := new(big.Int).SetUint64(chunk/NodeWidth + pos/NodeWidth)
+	key, err := GetTreeKey(address, treeIndex, byte(pos%NodeWidth))
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// CodeChunkKeys returns the tree keys of all the chunks needed to store
+// codeLen bytes of code, in chunk order. Chunks that live in the same
+// leaf share their stem, so the stem is only computed once per leaf. It
+// panics if the address is longer than 32 bytes or codeLen is negative.
+func CodeChunkKeys(address []byte, codeLen int) [][]byte {
+	if len(address) > AddressSize {
+		panic(errInvalidAddressSize)
+	}
+	if codeLen < 0 {
+		panic(fmt.Sprintf("invalid code length %d", codeLen))
+	}
+
+	count := (codeLen + CodeChunkSize - 1) / CodeChunkSize
+	keys := make([][]byte, count)
+	var stem []byte
+	for i := range keys {
+		pos := uint64(i) + CodeOffset
+		if stem == nil || pos%NodeWidth == 0 {
+			stem = CodeChunkKey(address, uint64(i))[:StemSize]
+		}
+		key := make([]byte, StemSize+1)
+		copy(key, stem)
+		key[StemSize] = byte(pos % NodeWidth)
+		keys[i] = key
+	}
+	return keys
+}
+
+// HistoryStorageAddress is the address of the system contract that
+// stores the hashes of recent blocks in its storage, as defined by
+// EIP-2935.
+var HistoryStorageAddress = [20]byte{
+	0x00, 0x00, 0xf9, 0x08, 0x27, 0xf1, 0xc5, 0x3a, 0x10, 0xcb,
+	0x7a, 0x02, 0x33, 0x5b, 0x17, 0x53, 0x20, 0x00, 0x29, 0x35,
+}
+
+// HistoryServeWindow is the number of block hashes kept by the history
+// storage contract. The hash of block n is stored in slot
+// n % HistoryServeWindow.
+const HistoryServeWindow = 8191
+
+// BeaconRootsAddress is the address of the system contract that stores
+// the roots of recent beacon blocks in its storage, as defined by
+// EIP-4788.
+var BeaconRootsAddress = [20]byte{
+	0x00, 0x0f, 0x3d, 0xf6, 0xd7, 0x32, 0x80, 0x7e, 0xf1, 0x31,
+	0x9f, 0xb7, 0xb8, 0xbb, 0x85, 0x22, 0xd0, 0xbe, 0xac, 0x02,
+}
+
+// BeaconRootsHistoryLength is the number of beacon roots kept by the
+// beacon roots contract.
+const BeaconRootsHistoryLength = 8191
+
+// SystemContractAddresses returns the addresses of the system contracts
+// whose storage slots are reserved by the protocol.
+func SystemContractAddresses() [][20]byte {
+	return [][20]byte{HistoryStorageAddress, BeaconRootsAddress}
+}
+
+// systemStorageKey returns the tree key of a storage slot of a system
+// contract. It can't fail, as system contract addresses are 20 bytes
+// long.
+func systemStorageKey(address [20]byte, slot uint64) []byte {
+	key, err := StorageSlotKey(address[:], new(big.Int).SetUint64(slot))
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// HeaderStorageKey returns the tree key of the field-th storage slot of
+// the history storage contract, which holds the hash of every block
+// whose number is equal to field modulo HistoryServeWindow. It panics
+// if field isn't in [0, HistoryServeWindow).
+func HeaderStorageKey(field int) []byte {
+	if field < 0 || field >= HistoryServeWindow {
+		panic(fmt.Sprintf("invalid header storage field %d", field))
+	}
+	return systemStorageKey(HistoryStorageAddress, uint64(field))
+}
+
+// BlockHashKey returns the tree key under which the history storage
+// contract keeps the hash of the given block.
+func BlockHashKey(number uint64) []byte {
+	return HeaderStorageKey(int(number % HistoryServeWindow))
+}
+
+// BeaconRootKeys returns the tree keys under which the beacon roots
+// contract keeps the timestamp and the root of the beacon block with
+// the given timestamp. Both share a ring buffer slot: the timestamp is
+// stored first, and the root BeaconRootsHistoryLength slots later.
+func BeaconRootKeys(timestamp uint64) (timestampKey, rootKey []byte) {
+	slot := timestamp % BeaconRootsHistoryLength
+	return systemStorageKey(BeaconRootsAddress, slot), systemStorageKey(BeaconRootsAddress, slot+BeaconRootsHistoryLength)
+}
+
+// addressToBytes32 left-pads an address to 32 bytes, so that both
+// 20-byte Ethereum addresses and 32-byte addresses are supported.
+func addressToBytes32(address []byte) ([AddressSize]byte, error) {
+	var ret [AddressSize]byte
+	if len(address) > AddressSize {
+		return ret, errInvalidAddressSize
+	}
+	copy(ret[AddressSize-len(address):], address)
+	return ret, nil
+}
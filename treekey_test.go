@@ -0,0 +1,294 @@
+package verkle
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestStorageSlotKeyHeaderAndMainStorage(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0x42}, 20)
+
+	// The first 64 storage slots live in the account header, along
+	// with the first 128 code chunks.
+	header, err := GetTreeKey(address, big.NewInt(0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot0, err := StorageSlotKey(address, big.NewInt(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalPaths(slot0, header) || slot0[StemSize] != HeaderStorageOffset {
+		t.Fatalf("slot 0 should be in the header stem at suffix %d, got %x", HeaderStorageOffset, slot0)
+	}
+	slot63, err := StorageSlotKey(address, big.NewInt(63))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalPaths(slot63, header) || slot63[StemSize] != CodeOffset-1 {
+		t.Fatalf("slot 63 should be in the header stem at suffix %d, got %x", CodeOffset-1, slot63)
+	}
+	chunk0 := CodeChunkKey(address, 0)
+	if !equalPaths(chunk0, header) || chunk0[StemSize] != CodeOffset {
+		t.Fatalf("code chunk 0 should be in the header stem at suffix %d, got %x", CodeOffset, chunk0)
+	}
+
+	// Slot 64 is the first main storage slot.
+	slot64, err := StorageSlotKey(address, big.NewInt(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equalPaths(slot64, header) || slot64[StemSize] != 64 {
+		t.Fatalf("slot 64 should be in the main storage, got %x", slot64)
+	}
+	treeIndex := new(big.Int).Rsh(MainStorageOffset, 8)
+	expected, err := GetTreeKey(address, treeIndex, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(slot64, expected) {
+		t.Fatalf("invalid key for slot 64: %x != %x", slot64, expected)
+	}
+}
+
+func TestCodeChunkKeyCrossesStems(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0x42}, 20)
+	last := CodeChunkKey(address, NodeWidth-CodeOffset-1)
+	if last[StemSize] != NodeWidth-1 {
+		t.Fatalf("invalid suffix for the last chunk in the header: %x", last)
+	}
+	first := CodeChunkKey(address, NodeWidth-CodeOffset)
+	if first[StemSize] != 0 || equalPaths(first, last) {
+		t.Fatalf("chunk %d should be at suffix 0 of a new stem: %x", NodeWidth-CodeOffset, first)
+	}
+	expected, err := GetTreeKey(address, big.NewInt(1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, expected) {
+		t.Fatalf("invalid key for chunk %d: %x != %x", NodeWidth-CodeOffset, first, expected)
+	}
+}
+
+func TestTreeKeyAddressPadding(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0x42}, 20)
+	padded := append(make([]byte, 12), address...)
+	key20, err := StorageSlotKey(address, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key32, err := StorageSlotKey(padded, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key20, key32) {
+		t.Fatalf("20-byte and padded addresses should produce the same key: %x != %x", key20, key32)
+	}
+
+	other, err := StorageSlotKey(bytes.Repeat([]byte{0x43}, 20), big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equalPaths(other, key20) {
+		t.Fatalf("different addresses should produce different stems")
+	}
+}
+
+func TestStorageSlotKeyInvalidInput(t *testing.T) {
+	t.Parallel()
+
+	if _, err := StorageSlotKey(make([]byte, 33), big.NewInt(0)); err != errInvalidAddressSize {
+		t.Fatalf("expected %v, got %v", errInvalidAddressSize, err)
+	}
+	if _, err := StorageSlotKey(make([]byte, 20), big.NewInt(-1)); err == nil {
+		t.Fatal("expected an error for a negative slot")
+	}
+	if _, err := StorageSlotKey(make([]byte, 20), new(big.Int).Lsh(big.NewInt(1), 256)); err == nil {
+		t.Fatal("expected an error for a slot larger than 256 bits")
+	}
+}
+
+func TestCodeChunkKeys(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0x42}, 20)
+	for _, codeLen := range []int{0, 1, CodeChunkSize, CodeChunkSize + 1, (NodeWidth - CodeOffset + 2) * CodeChunkSize} {
+		keys := CodeChunkKeys(address, codeLen)
+		if len(keys) != (codeLen+CodeChunkSize-1)/CodeChunkSize {
+			t.Fatalf("invalid number of keys for %d bytes: %d", codeLen, len(keys))
+		}
+		for i, key := range keys {
+			if expected := CodeChunkKey(address, uint64(i)); !bytes.Equal(key, expected) {
+				t.Fatalf("invalid key for chunk %d: %x != %x", i, key, expected)
+			}
+		}
+	}
+}
+
+func TestCodeChunkKeysInvalidInput(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		address []byte
+		codeLen int
+	}{
+		{make([]byte, 33), 1},
+		{make([]byte, 20), -1},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic for address length %d and code length %d", len(tc.address), tc.codeLen)
+				}
+			}()
+			CodeChunkKeys(tc.address, tc.codeLen)
+		}()
+	}
+}
+
+func TestAddressToStem(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0x42}, 20)
+	stem := AddressToStem(address)
+	if len(stem) != StemSize {
+		t.Fatalf("invalid stem length %d", len(stem))
+	}
+	for _, key := range [][]byte{
+		CodeChunkKey(address, 0),
+		mustStorageSlotKey(t, address, big.NewInt(0)),
+	} {
+		if !equalPaths(stem, key) {
+			t.Fatalf("key %x is not in the account header stem %x", key, stem)
+		}
+	}
+	if !bytes.Equal(AddressToStem(append(make([]byte, 12), address...)), stem) {
+		t.Fatal("20-byte and padded addresses should produce the same stem")
+	}
+}
+
+func mustStorageSlotKey(t *testing.T, address []byte, slot *big.Int) []byte {
+	t.Helper()
+
+	key, err := StorageSlotKey(address, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHeaderStorageKey(t *testing.T) {
+	t.Parallel()
+
+	for _, field := range []int{0, CodeOffset - HeaderStorageOffset, HistoryServeWindow - 1} {
+		if key, expected := HeaderStorageKey(field), mustStorageSlotKey(t, HistoryStorageAddress[:], big.NewInt(int64(field))); !bytes.Equal(key, expected) {
+			t.Fatalf("invalid key for field %d: %x != %x", field, key, expected)
+		}
+	}
+	if !bytes.Equal(BlockHashKey(HistoryServeWindow+5), HeaderStorageKey(5)) {
+		t.Fatal("block hashes should wrap around the history window")
+	}
+
+	for _, field := range []int{-1, HistoryServeWindow} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic for field %d", field)
+				}
+			}()
+			HeaderStorageKey(field)
+		}()
+	}
+}
+
+func TestBeaconRootKeys(t *testing.T) {
+	t.Parallel()
+
+	beaconRoots, err := hex.DecodeString("000F3df6D732807Ef1319fB7B8bB8522d0Beac02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestampKey, rootKey := BeaconRootKeys(BeaconRootsHistoryLength + 7)
+	if expected := mustStorageSlotKey(t, beaconRoots, big.NewInt(7)); !bytes.Equal(timestampKey, expected) {
+		t.Fatalf("invalid timestamp key: %x != %x", timestampKey, expected)
+	}
+	if expected := mustStorageSlotKey(t, beaconRoots, big.NewInt(BeaconRootsHistoryLength+7)); !bytes.Equal(rootKey, expected) {
+		t.Fatalf("invalid root key: %x != %x", rootKey, expected)
+	}
+
+	addresses := SystemContractAddresses()
+	if len(addresses) != 2 || addresses[0] != HistoryStorageAddress || addresses[1] != BeaconRootsAddress {
+		t.Fatalf("invalid system contract addresses: %x", addresses)
+	}
+	addresses[0][0] ^= 1
+	if SystemContractAddresses()[0] != HistoryStorageAddress {
+		t.Fatal("the registry of system contracts was modified through a returned slice")
+	}
+}
+
+// specTreeKey derives a tree key as written in the spec, independently
+// of GetTreeKey: the 64-byte input address32 || LE32(tree index) is cut
+// in 16-byte little-endian chunks, prefixed with 2 + 256 * len(input),
+// and padded with zeroes to the width of the commitment.
+func specTreeKey(t *testing.T, address32 []byte, treeIndex *big.Int, subIndex byte) []byte {
+	t.Helper()
+
+	input := make([]byte, 64)
+	copy(input, address32)
+	be := treeIndex.FillBytes(make([]byte, 32))
+	for i := range be {
+		input[32+i] = be[31-i]
+	}
+
+	poly := make([]Fr, NodeWidth)
+	poly[0].SetUint64(2 + 256*uint64(len(input)))
+	for i := 0; i < len(input)/16; i++ {
+		chunk := make([]byte, 32)
+		copy(chunk, input[16*i:16*(i+1)])
+		poly[1+i].SetBytesLE(chunk)
+	}
+
+	var hash Fr
+	GetConfig().CommitToPoly(poly, 0).MapToScalarField(&hash)
+	key := hash.BytesLE()
+	key[31] = subIndex
+	return key[:]
+}
+
+func TestTreeKeysMatchSpecDerivation(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0x42}, 20)
+	address32 := append(make([]byte, 12), address...)
+	mainStorage := new(big.Int).Lsh(big.NewInt(1), 248)
+
+	for _, tc := range []struct {
+		name      string
+		key       []byte
+		treeIndex *big.Int
+		subIndex  byte
+	}{
+		{"account header", AddressToStem(address), big.NewInt(0), 0},
+		{"header storage slot 5", mustStorageSlotKey(t, address, big.NewInt(5)), big.NewInt(0), 64 + 5},
+		// 256**31 + 1000 = 256 * (256**30 + 3) + 232
+		{"main storage slot 1000", mustStorageSlotKey(t, address, big.NewInt(1000)), new(big.Int).Add(new(big.Int).Rsh(mainStorage, 8), big.NewInt(3)), 232},
+		// 128 + 200 = 256 + 72
+		{"code chunk 200", CodeChunkKey(address, 200), big.NewInt(1), 72},
+	} {
+		expected := specTreeKey(t, address32, tc.treeIndex, tc.subIndex)
+		if len(tc.key) == StemSize {
+			expected = expected[:StemSize]
+		}
+		if !bytes.Equal(tc.key, expected) {
+			t.Fatalf("%s: invalid key %x, expected %x", tc.name, tc.key, expected)
+		}
+	}
+}